@@ -0,0 +1,355 @@
+package slap
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Aggregate holds statistics of a numeric field for one group
+// Group lists values of group fields in the order given
+type Aggregate struct {
+	Group []interface{}
+	Count int
+	Sum   float64
+	Min   float64
+	Max   float64
+	Avg   float64
+}
+
+// Distinct is a value of an indexed field with the number of records holding it
+type Distinct struct {
+	Value interface{}
+	Count int
+}
+
+// Aggregate computes count, sum, min, max and average of a numeric field
+// over query results grouped by given fields
+// Records are streamed, missing values count as zero
+// Groups are returned in ascending order of their values
+func (p *Store) Aggregate(q *Query, field string, group ...string) ([]Aggregate, error) {
+	val := reflect.Indirect(reflect.ValueOf(q.model)).Interface()
+
+	s, err := model(val, true)
+	if err != nil {
+		return nil, fmt.Errorf("Aggregate: %w", err)
+	}
+
+	err = p.reindex(s)
+	if err != nil {
+		return nil, fmt.Errorf("Aggregate: %w", err)
+	}
+
+	if !numeric(s.fields[field]) {
+		return nil, fmt.Errorf("Aggregate: %s %w", field, ErrInvalidParameter)
+	}
+
+	for _, g := range group {
+		if zero(s.fields[g]) == nil {
+			return nil, fmt.Errorf("Aggregate: %s %w", g, ErrInvalidParameter)
+		}
+	}
+
+	acc := make(map[string]*Aggregate)
+	c := q.cond(p, val)
+
+	err = p.db.View(func(txn *badger.Txn) error {
+		w, err := c.walk(txn, s, nil, val, nil)
+		if err != nil {
+			return err
+		}
+		defer w.close()
+
+		for {
+			id, ok, err := w.next()
+			if err != nil || !ok {
+				return err
+			}
+
+			var key []byte
+			gv := make([]interface{}, 0, len(group))
+			for _, g := range group {
+				x, err := p.value(txn, s, id, g)
+				if err != nil {
+					return err
+				}
+				k, err := toKey(x)
+				if err != nil {
+					return err
+				}
+				key = append(key, k...)
+				gv = append(gv, x)
+			}
+
+			x, err := p.value(txn, s, id, field)
+			if err != nil {
+				return err
+			}
+			f := float(x)
+
+			a, ok := acc[string(key)]
+			if !ok {
+				a = &Aggregate{Group: gv, Min: f, Max: f}
+				acc[string(key)] = a
+			}
+
+			a.Count++
+			a.Sum += f
+			if f < a.Min {
+				a.Min = f
+			}
+			if f > a.Max {
+				a.Max = f
+			}
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Aggregate: %w", err)
+	}
+
+	keys := make([]string, 0, len(acc))
+	for k := range acc {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	res := make([]Aggregate, 0, len(keys))
+	for _, k := range keys {
+		a := acc[k]
+		a.Avg = a.Sum / float64(a.Count)
+		res = append(res, *a)
+	}
+
+	return res, nil
+}
+
+// Min returns smallest value of field over query results
+// Indexed fields are answered by the first match of an ordered index walk
+// Missing values count as zero, returns false when nothing matches
+func (p *Store) Min(q *Query, field string) (interface{}, bool, error) {
+	x, ok, err := p.extreme(q, field, false)
+	if err != nil {
+		return nil, false, fmt.Errorf("Min: %w", err)
+	}
+
+	return x, ok, nil
+}
+
+// Max returns largest value of field over query results
+// Indexed fields are answered by the first match of an ordered index walk
+// Missing values count as zero, returns false when nothing matches
+func (p *Store) Max(q *Query, field string) (interface{}, bool, error) {
+	x, ok, err := p.extreme(q, field, true)
+	if err != nil {
+		return nil, false, fmt.Errorf("Max: %w", err)
+	}
+
+	return x, ok, nil
+}
+
+func (p *Store) extreme(q *Query, field string, desc bool) (interface{}, bool, error) {
+	val := reflect.Indirect(reflect.ValueOf(q.model)).Interface()
+
+	s, err := model(val, true)
+	if err != nil {
+		return nil, false, fmt.Errorf("extreme: %w", err)
+	}
+
+	err = p.reindex(s)
+	if err != nil {
+		return nil, false, fmt.Errorf("extreme: %w", err)
+	}
+
+	srt, err := sorting(s, []string{field})
+	if err != nil {
+		return nil, false, fmt.Errorf("extreme: %w", err)
+	}
+	srt[0].desc = desc
+
+	var res interface{}
+	found := false
+	c := q.cond(p, val)
+
+	err = p.db.View(func(txn *badger.Txn) error {
+		_, indexed := s.index[field]
+
+		ord := srt
+		if !indexed {
+			ord = nil
+		}
+
+		w, err := c.walk(txn, s, ord, val, nil)
+		if err != nil {
+			return err
+		}
+		defer w.close()
+
+		var best []byte
+		for {
+			id, ok, err := w.next()
+			if err != nil || !ok {
+				return err
+			}
+
+			x, err := p.value(txn, s, id, field)
+			if err != nil {
+				return err
+			}
+
+			if indexed {
+				res, found = x, true
+				return nil
+			}
+
+			key, err := toKey(x)
+			if err != nil {
+				return err
+			}
+
+			cmp := bytes.Compare(key, best)
+			if !found || (desc && cmp > 0) || (!desc && cmp < 0) {
+				res, best, found = x, key, true
+			}
+		}
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("extreme: %w", err)
+	}
+
+	return res, found, nil
+}
+
+// Distinct lists values of an indexed field in index order with record counts
+// Only index keys are read, limit of zero or less returns all values
+// Zero values are not indexed and so not listed
+// Seek is the cursor returned by a previous call, empty cursor when done
+func (p *Store) Distinct(table interface{}, field, seek string, limit int) ([]Distinct, string, error) {
+	s, err := model(table, true)
+	if err != nil {
+		return nil, "", fmt.Errorf("Distinct: %w", err)
+	}
+
+	err = p.reindex(s)
+	if err != nil {
+		return nil, "", fmt.Errorf("Distinct: %w", err)
+	}
+
+	t, ok := s.indexed()[field]
+	if !ok || t == _geo {
+		return nil, "", fmt.Errorf("Distinct: %s %w", field, ErrInvalidParameter)
+	}
+
+	k := p.key(s.name)
+	k.field = field
+	pfx := []byte(k.indexF())
+
+	start := pfx
+	if seek != "" {
+		last, err := base64.RawURLEncoding.DecodeString(seek)
+		if err != nil {
+			return nil, "", fmt.Errorf("Distinct: %w", ErrInvalidCursor)
+		}
+		// ';' follows ':' so seeking past it skips all IDs of the last value
+		start = append(append(append([]byte{}, pfx...), last...), ';')
+	}
+
+	res := []Distinct{}
+	next := ""
+
+	err = p.db.View(func(txn *badger.Txn) error {
+		ops := badger.DefaultIteratorOptions
+		ops.PrefetchValues = false
+		itr := txn.NewIterator(ops)
+		defer itr.Close()
+
+		var cur []byte
+		for itr.Seek(start); itr.ValidForPrefix(pfx); itr.Next() {
+			r := itr.Item().Key()[len(pfx):]
+			i := bytes.LastIndexByte(r, ':')
+			if i < 0 {
+				return ErrMalformedKey
+			}
+
+			if s.soft {
+				gone, err := p.deleted(txn, s.name, string(r[i+1:]))
+				if err != nil {
+					return err
+				}
+				if gone {
+					continue
+				}
+			}
+
+			if cur != nil && bytes.Equal(r[:i], cur) {
+				res[len(res)-1].Count++
+				continue
+			}
+
+			if limit > 0 && len(res) == limit {
+				next = base64.RawURLEncoding.EncodeToString(cur)
+				return nil
+			}
+
+			cur = append([]byte{}, r[:i]...)
+			x, err := fromKey(cur, t)
+			if err != nil {
+				return err
+			}
+			res = append(res, Distinct{Value: x, Count: 1})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("Distinct: %w", err)
+	}
+
+	return res, next, nil
+}
+
+// value reads and decodes one record field, missing fields are zero
+func (p *Store) value(txn *badger.Txn, s *shape, id, field string) (interface{}, error) {
+	t := s.fields[field]
+	k := p.key(s.name)
+	k.id, k.field = id, field
+
+	i, err := txn.Get([]byte(k.fieldK()))
+	if err == badger.ErrKeyNotFound {
+		return zero(t), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("value: %w", err)
+	}
+
+	var x interface{}
+	err = i.Value(func(v []byte) error {
+		x, err = fromBytes(v, t)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("value: %w", err)
+	}
+
+	return x, nil
+}
+
+func numeric(t string) bool {
+	return t == "int" || t == "int64" || t == "float64"
+}
+
+func float(x interface{}) float64 {
+	switch v := x.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	default:
+		return 0
+	}
+}
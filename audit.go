@@ -0,0 +1,496 @@
+package slap
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Entry is an audited change of one record
+// Old and New hold values of changed fields before and after
+// Hash chains the entry to the one before it
+type Entry struct {
+	Seq    uint64
+	Time   time.Time
+	Actor  string
+	Op     Op
+	Schema string
+	Table  string
+	ID     string
+	Fields []string
+	Old    map[string]interface{}
+	New    map[string]interface{}
+	Prev   []byte
+	Hash   []byte
+}
+
+// AuditFilter selects audit entries of the store schema, zero fields
+// match all, Table is a model struct, Until is exclusive
+type AuditFilter struct {
+	Table interface{}
+	ID    string
+	Actor string
+	Since time.Time
+	Until time.Time
+}
+
+// trail is a stored audit entry, values are kept encoded
+// Types lists field types known at write time for decoding
+type trail struct {
+	Seq    uint64
+	Time   int64
+	Actor  string
+	Op     Op
+	Schema string
+	Table  string
+	ID     string
+	Fields []string
+	Types  map[string]string
+	Old    map[string][]byte
+	New    map[string][]byte
+	Prev   []byte
+	Hash   []byte
+}
+
+// head is the last entry of the audit log, kept to detect truncation
+type head struct {
+	Seq  uint64
+	Hash []byte
+}
+
+type actorKey struct{}
+
+// ErrTampered ...
+var ErrTampered = errors.New("audit log tampered")
+
+// WithActor returns a context naming who performs changes
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// Context returns a store taking the audit actor from ctx
+func (p *Store) Context(ctx context.Context) *Store {
+	c := *p
+	c.ctx = ctx
+	return &c
+}
+
+// AuditLog lists audit entries matching filter, oldest first
+func (p *Store) AuditLog(f AuditFilter) ([]Entry, error) {
+	es := []Entry{}
+
+	err := p.db.View(func(txn *badger.Txn) error {
+		return p.trails(txn, f, func(t *trail) error {
+			es = append(es, t.entry())
+			return nil
+		})
+	})
+	if err != nil {
+		return []Entry{}, fmt.Errorf("AuditLog: %w", err)
+	}
+
+	return es, nil
+}
+
+// ExportAudit writes audit entries matching filter as JSON lines
+func (p *Store) ExportAudit(w io.Writer, f AuditFilter) error {
+	enc := json.NewEncoder(w)
+
+	err := p.db.View(func(txn *badger.Txn) error {
+		return p.trails(txn, f, func(t *trail) error {
+			return enc.Encode(t.entry())
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("ExportAudit: %w", err)
+	}
+
+	return nil
+}
+
+// VerifyAudit recomputes the hash chain of the whole audit log,
+// shared by all schemas, and checks its last entry against the stored head
+// Returns ErrTampered naming the first entry that does not match
+func (p *Store) VerifyAudit() error {
+	var prev []byte
+	var seq uint64
+
+	err := p.db.View(func(txn *badger.Txn) error {
+		err := chain(txn, func(t *trail) error {
+			seq++
+			if t.Seq != seq || !bytes.Equal(t.Prev, prev) || !bytes.Equal(t.Hash, t.sum()) {
+				return fmt.Errorf("entry %d %w", seq, ErrTampered)
+			}
+			prev = t.Hash
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		h, ok, err := top(txn)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case !ok && seq == 0:
+		case !ok:
+			return fmt.Errorf("head %w", ErrTampered)
+		case h.Seq > seq:
+			return fmt.Errorf("entry %d %w", seq+1, ErrTampered)
+		case h.Seq != seq || !bytes.Equal(h.Hash, prev):
+			return fmt.Errorf("head %w", ErrTampered)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("VerifyAudit: %w", err)
+	}
+
+	return nil
+}
+
+// trails calls fn with stored entries of the store schema matching filter in order
+func (p *Store) trails(txn *badger.Txn, f AuditFilter, fn func(*trail) error) error {
+	table := ""
+	if f.Table != nil {
+		s, err := model(f.Table, true)
+		if err != nil {
+			return fmt.Errorf("trails: %w", err)
+		}
+		table = s.name
+	}
+
+	return chain(txn, func(t *trail) error {
+		switch {
+		case t.Schema != p.schema:
+		case table != "" && t.Table != table:
+		case f.ID != "" && t.ID != f.ID:
+		case f.Actor != "" && t.Actor != f.Actor:
+		case !f.Since.IsZero() && t.Time < f.Since.UnixNano():
+		case !f.Until.IsZero() && t.Time >= f.Until.UnixNano():
+		default:
+			return fn(t)
+		}
+		return nil
+	})
+}
+
+// chain calls fn with every stored entry in order
+func chain(txn *badger.Txn, fn func(*trail) error) error {
+	pfx := []byte(_auditSchema + ":")
+
+	itr := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer itr.Close()
+
+	for itr.Seek(pfx); itr.ValidForPrefix(pfx); itr.Next() {
+		var t trail
+		err := itr.Item().Value(func(v []byte) error {
+			return gob.NewDecoder(bytes.NewReader(v)).Decode(&t)
+		})
+		if err != nil {
+			return fmt.Errorf("chain: %w", err)
+		}
+
+		err = fn(&t)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// write runs fn in a read write transaction
+// Transactions moving the audit log head or a text counter conflict
+// with any concurrent one doing the same, those are retried up to
+// _retries times, other conflicts are returned
+func (p *Store) write(fn func(*badger.Txn) error) error {
+	for n := 0; ; n++ {
+		var tx *badger.Txn
+		err := p.db.Update(func(txn *badger.Txn) error {
+			tx = txn
+			return fn(txn)
+		})
+
+		_, shared := p.db.shared.LoadAndDelete(tx)
+		if shared && errors.Is(err, badger.ErrConflict) && n < _retries {
+			backoff(n)
+			continue
+		}
+		return err
+	}
+}
+
+// prior captures record fields before a change of an audited table
+func (p *Store) prior(txn *badger.Txn, audit bool, table, id string) (map[string][]byte, error) {
+	if !audit {
+		return nil, nil
+	}
+
+	k := p.key(table)
+	k.id = id
+
+	return state(txn, k)
+}
+
+// log appends an audit entry for a change of record id of an audited table
+// Before holds fields prior to the change, types their field types
+func (p *Store) log(txn *badger.Txn, audit bool, table, id string, op Op, types map[string]string, before map[string][]byte) error {
+	if !audit {
+		return nil
+	}
+
+	k := p.key(table)
+	k.id = id
+
+	after := make(map[string][]byte)
+	if op != Deleted {
+		var err error
+		after, err = state(txn, k)
+		if err != nil {
+			return fmt.Errorf("log: %w", err)
+		}
+	}
+
+	t := trail{
+		Time:   time.Now().UnixNano(),
+		Op:     op,
+		Schema: p.schema,
+		Table:  table,
+		ID:     id,
+		Fields: diff(before, after),
+		Types:  make(map[string]string),
+		Old:    make(map[string][]byte),
+		New:    make(map[string][]byte),
+	}
+
+	if p.ctx != nil {
+		t.Actor, _ = p.ctx.Value(actorKey{}).(string)
+	}
+
+	for _, f := range t.Fields {
+		if v, ok := before[f]; ok {
+			t.Old[f] = v
+		}
+		if v, ok := after[f]; ok {
+			t.New[f] = v
+		}
+		if typ, ok := types[f]; ok {
+			t.Types[f] = typ
+		}
+	}
+
+	h, ok, err := top(txn)
+	if err != nil {
+		return fmt.Errorf("log: %w", err)
+	}
+	if !ok {
+		h, err = last(txn)
+		if err != nil {
+			return fmt.Errorf("log: %w", err)
+		}
+	}
+
+	t.Seq, t.Prev = h.Seq+1, h.Hash
+	t.Hash = t.sum()
+
+	bts, err := toBytes(t)
+	if err != nil {
+		return fmt.Errorf("log: %w", err)
+	}
+
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, t.Seq)
+
+	err = txn.Set(append([]byte(_auditSchema+":"), seq...), bts)
+	if err != nil {
+		return fmt.Errorf("log: %w", err)
+	}
+
+	bts, err = toBytes(head{Seq: t.Seq, Hash: t.Hash})
+	if err != nil {
+		return fmt.Errorf("log: %w", err)
+	}
+
+	err = txn.Set([]byte(_auditHead), bts)
+	if err != nil {
+		return fmt.Errorf("log: %w", err)
+	}
+	p.db.shared.Store(txn, null{})
+
+	return nil
+}
+
+// top reads the audit log head, false when nothing was logged
+func top(txn *badger.Txn) (head, bool, error) {
+	var h head
+
+	i, err := txn.Get([]byte(_auditHead))
+	if err == badger.ErrKeyNotFound {
+		return h, false, nil
+	}
+	if err != nil {
+		return h, false, fmt.Errorf("top: %w", err)
+	}
+
+	err = i.Value(func(v []byte) error {
+		return gob.NewDecoder(bytes.NewReader(v)).Decode(&h)
+	})
+	if err != nil {
+		return h, false, fmt.Errorf("top: %w", err)
+	}
+
+	return h, true, nil
+}
+
+// last reads the last stored audit entry when the head is missing
+func last(txn *badger.Txn) (head, error) {
+	var h head
+
+	ops := badger.DefaultIteratorOptions
+	ops.Reverse = true
+	itr := txn.NewIterator(ops)
+	defer itr.Close()
+
+	pfx := []byte(_auditSchema + ":")
+	itr.Seek(append(pfx, ordinal(math.MaxInt64)...))
+	if !itr.ValidForPrefix(pfx) {
+		return h, nil
+	}
+
+	var t trail
+	err := itr.Item().Value(func(v []byte) error {
+		return gob.NewDecoder(bytes.NewReader(v)).Decode(&t)
+	})
+	if err != nil {
+		return h, fmt.Errorf("last: %w", err)
+	}
+
+	return head{Seq: t.Seq, Hash: t.Hash}, nil
+}
+
+// state reads encoded field values of a record
+func state(txn *badger.Txn, k *bow) (map[string][]byte, error) {
+	vs := make(map[string][]byte)
+	pfx := []byte(k.recordK() + ":")
+
+	itr := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer itr.Close()
+
+	for itr.Seek(pfx); itr.ValidForPrefix(pfx); itr.Next() {
+		v, err := itr.Item().ValueCopy(nil)
+		if err != nil {
+			return nil, fmt.Errorf("state: %w", err)
+		}
+		vs[string(itr.Item().Key()[len(pfx):])] = v
+	}
+
+	return vs, nil
+}
+
+// diff lists sorted fields whose encoded values differ
+func diff(a, b map[string][]byte) []string {
+	fs := []string{}
+
+	for f, v := range b {
+		if w, ok := a[f]; !ok || !bytes.Equal(v, w) {
+			fs = append(fs, f)
+		}
+	}
+	for f := range a {
+		if _, ok := b[f]; !ok {
+			fs = append(fs, f)
+		}
+	}
+	sort.Strings(fs)
+
+	return fs
+}
+
+// sum hashes an entry together with the hash before it
+// Fields are written length prefixed in a fixed order
+func (t *trail) sum() []byte {
+	h := sha256.New()
+
+	w := func(b []byte) {
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], uint64(len(b)))
+		h.Write(n[:])
+		h.Write(b)
+	}
+	num := func(x uint64) {
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], x)
+		w(n[:])
+	}
+
+	w(t.Prev)
+	num(t.Seq)
+	num(uint64(t.Time))
+	w([]byte(t.Actor))
+	num(uint64(t.Op))
+	w([]byte(t.Schema))
+	w([]byte(t.Table))
+	w([]byte(t.ID))
+	for _, f := range t.Fields {
+		w([]byte(f))
+		w([]byte(t.Types[f]))
+		w(t.Old[f])
+		w(t.New[f])
+	}
+
+	return h.Sum(nil)
+}
+
+// entry decodes a stored entry
+// Values of unknown type are left encoded
+func (t *trail) entry() Entry {
+	e := Entry{
+		Seq:    t.Seq,
+		Time:   time.Unix(0, t.Time),
+		Actor:  t.Actor,
+		Op:     t.Op,
+		Schema: t.Schema,
+		Table:  t.Table,
+		ID:     t.ID,
+		Fields: t.Fields,
+		Old:    make(map[string]interface{}),
+		New:    make(map[string]interface{}),
+		Prev:   t.Prev,
+		Hash:   t.Hash,
+	}
+	if e.Fields == nil {
+		e.Fields = []string{}
+	}
+
+	for f, v := range t.Old {
+		e.Old[f] = t.decode(f, v)
+	}
+	for f, v := range t.New {
+		e.New[f] = t.decode(f, v)
+	}
+
+	return e
+}
+
+func (t *trail) decode(f string, v []byte) interface{} {
+	x, err := fromBytes(v, t.Types[f])
+	if err != nil {
+		return v
+	}
+	return x
+}
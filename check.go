@@ -0,0 +1,481 @@
+package slap
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Issue classifies an inconsistency found by Check
+type Issue int
+
+const (
+	// OrphanIndex is an index entry without a matching field value
+	OrphanIndex Issue = iota + 1
+	// MissingIndex is an indexed field value without an index entry
+	MissingIndex
+	// BadValue is a field value that does not decode into the field type
+	BadValue
+	// OrphanField is a field key without a record marker
+	OrphanField
+	// StaleIndex is an index entry of an older index format
+	StaleIndex
+)
+
+func (i Issue) String() string {
+	switch i {
+	case OrphanIndex:
+		return "orphan index"
+	case MissingIndex:
+		return "missing index"
+	case BadValue:
+		return "bad value"
+	case OrphanField:
+		return "orphan field"
+	case StaleIndex:
+		return "stale index"
+	default:
+		return "unknown"
+	}
+}
+
+// Fault describes a single inconsistency
+// Key is the offending key, or the expected one for MissingIndex
+type Fault struct {
+	Issue Issue
+	Table string
+	ID    string
+	Field string
+	Key   string
+}
+
+// Report is the outcome of Check or Repair
+type Report struct {
+	Records int
+	Fields  int
+	Indexes int
+	Faults  []Fault
+	Fixed   int
+}
+
+// Clean reports whether no faults were found
+func (r *Report) Clean() bool {
+	return len(r.Faults) == 0
+}
+
+// patch is a fault Repair fixes, shape holds its table
+type patch struct {
+	s *shape
+	f Fault
+}
+
+// Check walks record, field and index keyspaces of given tables
+// Accepts structs or struct pointers, reports faults without fixing them
+func (p *Store) Check(tables ...interface{}) (*Report, error) {
+	rep, _, err := p.check(tables)
+	if err != nil {
+		return rep, fmt.Errorf("Check: %w", err)
+	}
+
+	return rep, nil
+}
+
+// Repair runs Check and fixes what can be fixed
+// Orphan and stale indexes and orphan fields are removed, missing
+// indexes are added, bad values are reported but left in place
+// Each fault is checked again in the transaction fixing it, faults
+// resolved by writes made in between are left alone
+// Repaired tables are marked as holding the current index format
+func (p *Store) Repair(tables ...interface{}) (*Report, error) {
+	rep, fix, err := p.check(tables)
+	if err != nil {
+		return rep, fmt.Errorf("Repair: %w", err)
+	}
+
+	for len(fix) > 0 {
+		n, fixed := 0, 0
+		err = p.retry(func(txn *badger.Txn) error {
+			n, fixed = 0, 0
+			for ; n < len(fix); n++ {
+				ok, err := p.mend(txn, fix[n])
+				if err == badger.ErrTxnTooBig && n > 0 {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if ok {
+					fixed++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return rep, fmt.Errorf("Repair: %w", err)
+		}
+
+		rep.Fixed += fixed
+		fix = fix[n:]
+	}
+
+	err = p.write(func(txn *badger.Txn) error {
+		for _, t := range tables {
+			s, err := model(t, true)
+			if err != nil {
+				return err
+			}
+
+			err = txn.Set([]byte(p.key(s.name).formatK()), stamp(_format))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return rep, fmt.Errorf("Repair: %w", err)
+	}
+
+	return rep, nil
+}
+
+// reindex runs Repair once on a table whose index format is outdated
+// Index entries of older formats cannot be found by current lookups
+func (p *Store) reindex(s *shape) error {
+	cur := false
+	err := p.db.View(func(txn *badger.Txn) error {
+		i, err := txn.Get([]byte(p.key(s.name).formatK()))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		n, err := version(i)
+		cur = n == _format
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("reindex: %w", err)
+	}
+	if cur {
+		return nil
+	}
+
+	_, err = p.Repair(reflect.New(s.cast).Interface())
+	if err != nil {
+		return fmt.Errorf("reindex: %w", err)
+	}
+
+	return nil
+}
+
+func (p *Store) check(tables []interface{}) (*Report, []patch, error) {
+	rep := &Report{Faults: []Fault{}}
+	var fix []patch
+
+	for _, t := range tables {
+		s, err := model(t, true)
+		if err != nil {
+			return rep, nil, fmt.Errorf("check: %w", err)
+		}
+
+		n := len(rep.Faults)
+		err = p.db.View(func(txn *badger.Txn) error {
+			err := p.checkFields(txn, s, rep)
+			if err != nil {
+				return err
+			}
+
+			return p.checkIndex(txn, s, rep)
+		})
+		if err != nil {
+			return rep, nil, fmt.Errorf("check: %w", err)
+		}
+
+		for _, f := range rep.Faults[n:] {
+			if f.Issue != BadValue {
+				fix = append(fix, patch{s: s, f: f})
+			}
+		}
+	}
+
+	return rep, fix, nil
+}
+
+// mend fixes a fault if it still holds
+// Reports whether the fault is gone afterwards
+func (p *Store) mend(txn *badger.Txn, x patch) (bool, error) {
+	k := p.key(x.s.name)
+	k.id, k.field = x.f.ID, x.f.Field
+	_, k.index = x.s.index[k.field]
+	t := x.s.indexed()[k.field]
+
+	_, err := txn.Get([]byte(k.recordK()))
+	if err != nil && err != badger.ErrKeyNotFound {
+		return false, fmt.Errorf("mend: %w", err)
+	}
+	rec := err == nil
+
+	switch x.f.Issue {
+	case OrphanIndex:
+		_, err := txn.Get([]byte(x.f.Key))
+		if err == badger.ErrKeyNotFound {
+			return true, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("mend: %w", err)
+		}
+
+		live, err := p.live(txn, x.s, x.f.Key)
+		if err != nil || live {
+			return false, err
+		}
+
+		err = txn.Delete([]byte(x.f.Key))
+		if err != nil {
+			return false, fmt.Errorf("mend: %w", err)
+		}
+	case MissingIndex:
+		i, err := txn.Get([]byte(k.fieldK()))
+		if err == badger.ErrKeyNotFound || !rec {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("mend: %w", err)
+		}
+
+		var key []byte
+		err = i.Value(func(v []byte) error {
+			key, err = indexKey(v, t)
+			return err
+		})
+		if err != nil || k.indexK(key) != x.f.Key {
+			return false, nil
+		}
+
+		err = put(txn, []byte(x.f.Key), []byte{0}, i.ExpiresAt())
+		if err != nil {
+			return false, fmt.Errorf("mend: %w", err)
+		}
+	case StaleIndex:
+		err := txn.Delete([]byte(x.f.Key))
+		if err != nil {
+			return false, fmt.Errorf("mend: %w", err)
+		}
+	case OrphanField:
+		if rec {
+			return false, nil
+		}
+
+		i, err := txn.Get([]byte(x.f.Key))
+		if err == badger.ErrKeyNotFound {
+			return true, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("mend: %w", err)
+		}
+
+		// index entry goes first, it can only be found through the field
+		if k.index {
+			err = i.Value(func(v []byte) error {
+				key, err := indexKey(v, t)
+				if err != nil {
+					return nil
+				}
+				return txn.Delete([]byte(k.indexK(key)))
+			})
+			if err != nil {
+				return false, fmt.Errorf("mend: %w", err)
+			}
+		}
+
+		err = txn.Delete([]byte(x.f.Key))
+		if err != nil {
+			return false, fmt.Errorf("mend: %w", err)
+		}
+	default:
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// checkFields walks record and field keys of a table
+// Record marker sorts before its fields so one pass is enough
+func (p *Store) checkFields(txn *badger.Txn, s *shape, rep *Report) error {
+	k := p.key(s.name)
+	pfx := []byte(k.tableK() + ":")
+	idx := s.indexed()
+	rec := ""
+
+	itr := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer itr.Close()
+
+	for itr.Seek(pfx); itr.ValidForPrefix(pfx); itr.Next() {
+		fk := string(itr.Item().Key())
+		part := strings.Split(fk, ":")
+
+		switch len(part) {
+		case 3:
+			rec = part[2]
+			rep.Records++
+			continue
+		case 4:
+			rep.Fields++
+		default:
+			continue
+		}
+
+		k.id, k.field = part[2], part[3]
+		_, k.index = s.index[k.field]
+
+		if k.id != rec {
+			rep.Faults = append(rep.Faults, Fault{OrphanField, s.name, k.id, k.field, fk})
+			continue
+		}
+
+		t, known := s.fields[k.field]
+		if !known {
+			continue
+		}
+		if k.index {
+			t = idx[k.field]
+		}
+
+		var key []byte
+		err := itr.Item().Value(func(v []byte) error {
+			if !k.index {
+				_, err := fromBytes(v, t)
+				return err
+			}
+
+			var err error
+			key, err = indexKey(v, t)
+			if err != nil {
+				return err
+			}
+
+			_, err = txn.Get([]byte(k.legacyK(v)))
+			if err == nil {
+				rep.Faults = append(rep.Faults, Fault{StaleIndex, s.name, k.id, k.field, k.legacyK(v)})
+			}
+			if err == badger.ErrKeyNotFound {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			rep.Faults = append(rep.Faults, Fault{BadValue, s.name, k.id, k.field, fk})
+			continue
+		}
+
+		if !k.index {
+			continue
+		}
+
+		_, err = txn.Get([]byte(k.indexK(key)))
+		if err == badger.ErrKeyNotFound {
+			rep.Faults = append(rep.Faults, Fault{MissingIndex, s.name, k.id, k.field, k.indexK(key)})
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("checkFields: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// checkIndex walks index keys of a table
+// Each entry must point at a live field holding the same value
+func (p *Store) checkIndex(txn *badger.Txn, s *shape, rep *Report) error {
+	k := p.key(s.name)
+	pfx := []byte(k.indexT())
+
+	ops := badger.DefaultIteratorOptions
+	ops.PrefetchValues = false
+	itr := txn.NewIterator(ops)
+	defer itr.Close()
+
+	for itr.Seek(pfx); itr.ValidForPrefix(pfx); itr.Next() {
+		key := string(itr.Item().Key())
+		rep.Indexes++
+
+		live, err := p.live(txn, s, key)
+		if err != nil {
+			return fmt.Errorf("checkIndex: %w", err)
+		}
+
+		if !live {
+			field, _, id, _ := splitIndexK(key[len(pfx):])
+			rep.Faults = append(rep.Faults, Fault{OrphanIndex, s.name, id, field, key})
+		}
+	}
+
+	return nil
+}
+
+// live reports whether an index entry points at a field holding its value
+func (p *Store) live(txn *badger.Txn, s *shape, key string) (bool, error) {
+	k := p.key(s.name)
+	pfx := k.indexT()
+	if !strings.HasPrefix(key, pfx) {
+		return false, nil
+	}
+
+	field, val, id, err := splitIndexK(key[len(pfx):])
+	if err != nil {
+		return false, nil
+	}
+
+	k.id, k.field = id, field
+	t, indexed := s.indexed()[field]
+	if !indexed {
+		return false, nil
+	}
+
+	_, err = txn.Get([]byte(k.recordK()))
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("live: %w", err)
+	}
+
+	i, err := txn.Get([]byte(k.fieldK()))
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("live: %w", err)
+	}
+
+	live := false
+	err = i.Value(func(v []byte) error {
+		key, err := indexKey(v, t)
+		live = err == nil && bytes.Equal(key, []byte(val))
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("live: %w", err)
+	}
+
+	return live, nil
+}
+
+// splitIndexK breaks index key remainder field:value:id into parts
+// Values may contain separators, field names and IDs may not
+func splitIndexK(r string) (string, string, string, error) {
+	f := strings.Index(r, ":")
+	i := strings.LastIndex(r, ":")
+	if f < 0 || i <= f {
+		return "", "", "", ErrMalformedKey
+	}
+
+	return r[:f], r[f+1 : i], r[i+1:], nil
+}
@@ -1,10 +1,12 @@
 package slap
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/dgraph-io/badger/v3"
 )
@@ -29,7 +31,33 @@ func (p *Store) Tidy() {
 	p.db.Close()
 }
 
+// Atomic returns a store running multi ID operations in one transaction
+// Either all IDs are processed or none is
+func (p *Store) Atomic() *Store {
+	c := *p
+	c.atomic = true
+	return &c
+}
+
+// TTL returns a store writing records that expire after d
+// A ttl tagged field of the record takes precedence
+func (p *Store) TTL(d time.Duration) *Store {
+	c := *p
+	c.ttl = d
+	return &c
+}
+
+// Clock returns a store reading time from fn for created and updated fields
+func (p *Store) Clock(fn func() time.Time) *Store {
+	c := *p
+	c.clock = fn
+	return &c
+}
+
 // Create accepts struct or slice of struct pointers
+// Zero created and updated tagged fields are set to now
+// Zero values are neither stored nor indexed
+// ID fields and create hook changes are set on data once committed
 // Returns slice of record IDs saved
 func (p *Store) Create(data interface{}) ([]string, error) {
 	ids := []string{}
@@ -42,17 +70,12 @@ func (p *Store) Create(data interface{}) ([]string, error) {
 
 	switch kin {
 	case reflect.Struct:
-		s, err := model(ind.Interface(), false)
+		s, err := model(ind.Interface(), true)
 		if err != nil {
 			return ids, fmt.Errorf("Create: %w", err)
 		}
 
-		v, err := s.values(ind.Interface())
-		if err != nil {
-			return ids, fmt.Errorf("Create: %w", err)
-		}
-
-		id, err := p.create(s, v)
+		id, err := p.create(s, ind)
 		if err != nil {
 			return ids, fmt.Errorf("Create: %w", err)
 		}
@@ -62,19 +85,13 @@ func (p *Store) Create(data interface{}) ([]string, error) {
 		if ind.Len() == 0 {
 			return ids, nil
 		}
-		s, err := model(ind.Index(0).Interface(), false)
+		s, err := model(ind.Index(0).Interface(), true)
 		if err != nil {
 			return ids, fmt.Errorf("Create: %w", err)
 		}
 
-		var v vals
 		for i := 0; i < ind.Len(); i++ {
-			v, err = s.values(ind.Index(i).Interface())
-			if err != nil {
-				return ids, fmt.Errorf("Create: %w", err)
-			}
-
-			id, err := p.create(s, v)
+			id, err := p.create(s, ind.Index(i))
 			if err != nil {
 				return ids, fmt.Errorf("Create: %w", err)
 			}
@@ -90,60 +107,71 @@ func (p *Store) Create(data interface{}) ([]string, error) {
 
 // Delete removes one or many records with given IDs
 // Accepts a struct and variadic IDs
-func (p *Store) Delete(data interface{}, ids ...string) error {
+// Returns IDs removed and IDs not found
+// Each ID is removed in its own transaction unless store is Atomic
+// Atomic deletes ignore references held by records of the same batch
+func (p *Store) Delete(data interface{}, ids ...string) ([]string, []string, error) {
+	removed, missing := []string{}, []string{}
 	s, err := model(data, true)
 	if err != nil {
-		return fmt.Errorf("Delete: %w", err)
+		return removed, missing, fmt.Errorf("Delete: %w", err)
 	}
 
-	k := bow{
-		schema: p.schema,
-		table:  s.cast.Name(),
-	}
-
-	for _, id := range ids {
-		k.id = id
-
-		err = p.db.Update(func(txn *badger.Txn) error {
-			_, err := txn.Get([]byte(k.recordK()))
-			if err == badger.ErrKeyNotFound {
-				return nil
+	if p.atomic {
+		err = p.write(func(txn *badger.Txn) error {
+			removed, missing = removed[:0], missing[:0]
+			seen := make(map[string]bool)
+			k := p.key(s.name)
+			for _, id := range ids {
+				k.id = id
+				seen[k.recordK()] = false
 			}
-			if err != nil {
-				return fmt.Errorf("Update: %w", err)
-			}
-
-			for f := range s.fields {
-				k.field = f
-
-				if k.index {
-					i, err := txn.Get([]byte(k.fieldK()))
-					if err != nil {
-						return fmt.Errorf("Update: %w", err)
-					}
-
-					err = i.Value(func(v []byte) error {
-						return txn.Delete([]byte(k.indexK(v)))
-					})
-					if err != nil {
-						return fmt.Errorf("Update: %w", err)
-					}
-				}
 
-				err = txn.Delete([]byte(k.fieldK()))
+			for _, id := range ids {
+				ok, err := p.delete(txn, s, id, seen)
 				if err != nil {
-					return fmt.Errorf("Update: %w", err)
+					return err
+				}
+				if ok {
+					removed = append(removed, id)
+				} else {
+					missing = append(missing, id)
 				}
 			}
-			return txn.Delete([]byte(k.recordK()))
+			return nil
 		})
+		if errors.Is(err, badger.ErrTxnTooBig) {
+			err = ErrBatchTooBig
+		}
+		if err != nil {
+			return []string{}, []string{}, fmt.Errorf("Delete: %w", err)
+		}
+
+		return removed, missing, nil
 	}
 
-	return nil
+	for _, id := range ids {
+		var ok bool
+		err = p.write(func(txn *badger.Txn) error {
+			ok, err = p.delete(txn, s, id, make(map[string]bool))
+			return err
+		})
+		if err != nil {
+			return removed, missing, fmt.Errorf("Delete: %w", err)
+		}
+		if ok {
+			removed = append(removed, id)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+
+	return removed, missing, nil
 }
 
 // Update mofifies records with given IDs
 // Non zero values are updated
+// Updated tagged field is set to now, created tagged field is kept
 func (p *Store) Update(data interface{}, ids ...string) error {
 	s, err := model(data, false)
 	if err != nil {
@@ -155,71 +183,96 @@ func (p *Store) Update(data interface{}, ids ...string) error {
 		return fmt.Errorf("Update: %w", err)
 	}
 
-	k := bow{
-		schema: p.schema,
-		table:  s.cast.Name(),
+	if p.atomic {
+		err = p.write(func(txn *badger.Txn) error {
+			for _, id := range ids {
+				err := p.revise(txn, data, s, v, id)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if errors.Is(err, badger.ErrTxnTooBig) {
+			err = ErrBatchTooBig
+		}
+		if err != nil {
+			return fmt.Errorf("Update: %w", err)
+		}
+
+		return nil
 	}
 
 	for _, id := range ids {
-		k.id = id
+		err = p.write(func(txn *badger.Txn) error {
+			return p.revise(txn, data, s, v, id)
+		})
+		if err != nil {
+			return fmt.Errorf("Update: %w", err)
+		}
+	}
 
-		err = p.db.Update(func(txn *badger.Txn) error {
-			_, err := txn.Get([]byte(k.recordK()))
-			if err == badger.ErrKeyNotFound {
-				return fmt.Errorf("Update: %w", ErrNoRecord)
-			}
-			if err != nil {
-				return fmt.Errorf("Update: %w", err)
-			}
+	return nil
+}
 
-			for f := range s.fields {
-				_, k.index = s.index[f]
-				k.field = f
+// UpdateIf modifies record with given ID when its version equals ver
+// Returns ErrVersionConflict when the record changed meanwhile
+func (p *Store) UpdateIf(data interface{}, ver uint64, id string) error {
+	s, err := model(data, false)
+	if err != nil {
+		return fmt.Errorf("UpdateIf: %w", err)
+	}
 
-				bts, err := toBytes(v[f])
-				if err != nil {
-					return fmt.Errorf("Update: %w", err)
-				}
+	v, err := s.values(data)
+	if err != nil {
+		return fmt.Errorf("UpdateIf: %w", err)
+	}
 
-				if k.index {
-					err = txn.Set([]byte(k.indexK(bts)), []byte{0})
-					if err != nil {
-						return fmt.Errorf("Update: %w", err)
-					}
-
-					i, err := txn.Get([]byte(k.fieldK()))
-					if err != nil && err != badger.ErrKeyNotFound {
-						return fmt.Errorf("Update: %w", err)
-					}
-
-					if err == nil {
-						err = i.Value(func(v []byte) error {
-							return txn.Delete([]byte(k.indexK(v)))
-						})
-						if err != nil {
-							return fmt.Errorf("Update: %w", err)
-						}
-					}
-				}
+	err = p.write(func(txn *badger.Txn) error {
+		err := p.expect(txn, s.name, id, ver)
+		if err != nil {
+			return err
+		}
+		return p.revise(txn, data, s, v, id)
+	})
+	if errors.Is(err, badger.ErrConflict) {
+		err = ErrVersionConflict
+	}
+	if err != nil {
+		return fmt.Errorf("UpdateIf: %w", err)
+	}
 
-				err = txn.Set([]byte(k.fieldK()), bts)
-				if err != nil {
-					return fmt.Errorf("Update: %w", err)
-				}
-			}
+	return nil
+}
 
-			return nil
-		})
+// DeleteIf removes record with given ID when its version equals ver
+// Returns ErrVersionConflict when the record changed meanwhile
+func (p *Store) DeleteIf(data interface{}, ver uint64, id string) error {
+	s, err := model(data, true)
+	if err != nil {
+		return fmt.Errorf("DeleteIf: %w", err)
+	}
 
+	err = p.write(func(txn *badger.Txn) error {
+		err := p.expect(txn, s.name, id, ver)
 		if err != nil {
-			return fmt.Errorf("Update: %w", err)
+			return err
 		}
+		_, err = p.delete(txn, s, id, make(map[string]bool))
+		return err
+	})
+	if errors.Is(err, badger.ErrConflict) {
+		err = ErrVersionConflict
+	}
+	if err != nil {
+		return fmt.Errorf("DeleteIf: %w", err)
 	}
 
 	return nil
 }
 
 // Read retrieves one or many records with given IDs
+// A uint64 field tagged version receives the record version
 // Returns slice of interfaces
 func (p *Store) Read(data interface{}, ftr []string, ids ...string) ([]interface{}, error) {
 	rec := []interface{}{}
@@ -244,16 +297,16 @@ func (p *Store) Read(data interface{}, ftr []string, ids ...string) ([]interface
 	return rec, nil
 }
 
-// Select retrieves records ANDing non zero values
+// Select retrieves records ANDing non zero values, zero struct selects none
+// Optional order sorts by fields, minus prefix sorts descending
+// Use Query to select all records or to paginate with Limit and Page
 // Returns slice of interfaces
-func (p *Store) Select(x interface{}, ftr []string) ([]interface{}, error) {
-	val := reflect.Indirect(reflect.ValueOf(x)).Interface()
-	ids, err := p.where(val)
-	if err != nil {
-		return nil, fmt.Errorf("Select: %w", err)
+func (p *Store) Select(x interface{}, ftr []string, order ...string) ([]interface{}, error) {
+	if val := reflect.Indirect(reflect.ValueOf(x)); val.Kind() == reflect.Struct && val.IsZero() {
+		return []interface{}{}, nil
 	}
 
-	obs, err := p.Read(x, ftr, ids...)
+	obs, err := p.Query(x).Fields(ftr...).Order(order...).Run()
 	if err != nil {
 		return nil, fmt.Errorf("Select: %w", err)
 	}
@@ -266,90 +319,23 @@ func (p *Store) WithDB(f func(*badger.DB) error) (err error) {
 	return f(p.db.DB)
 }
 
-// Take ...
-func (p *Store) Take(table interface{}, filter []string, seek string, limit int) ([]interface{}, error) {
-	result := []interface{}{}
-	shape, err := model(table, true)
-	if err != nil {
-		return result, fmt.Errorf("Take: %w", err)
+// Take retrieves up to limit records of a table within span
+// Zero limit takes all, optional order sorts as in Select
+// Span positions follow the given order, ID order without one
+// Returns ID to seek for the next page, empty when there is none
+func (p *Store) Take(table interface{}, filter []string, span Span, limit int, order ...string) ([]interface{}, string, error) {
+	val := reflect.Indirect(reflect.ValueOf(table))
+	if val.Kind() != reflect.Struct {
+		return []interface{}{}, "", fmt.Errorf("Take: %w", ErrInvalidParameter)
 	}
 
-	shape.filter(filter)
-	key := p.key(shape.name)
-
-	err = p.db.View(func(txn *badger.Txn) error {
-		itr := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer itr.Close()
-		pfx := key.tableK()
-		sek := pfx
-		if seek != "" {
-			key.id = seek
-			sek = key.recordK()
-		}
-		ids := []string{}
-
-		count := limit
-		if limit == 0 {
-			count++
-		}
-
-		for itr.Seek([]byte(sek)); itr.ValidForPrefix([]byte(pfx)) && count > 0; itr.Next() {
-			k := itr.Item().Key()
-			s := strings.Split(string(k), ":")
-			if len(s) != 3 {
-				continue
-			}
-
-			ids = append(ids, s[2])
-			if limit != 0 {
-				count--
-			}
-		}
-
-		kst := bow{
-			schema: p.schema,
-			table:  shape.cast.Name(),
-		}
-
-		for _, id := range ids {
-			kst.id = id
-			obj := reflect.New(shape.cast).Elem()
-			obj.FieldByName("ID").Set(reflect.ValueOf(id))
-
-			for f, t := range shape.fields {
-				kst.field = f
+	q := p.Query(reflect.New(val.Type()).Interface()).Fields(filter...).Order(order...).Span(span).Limit(limit)
+	q.all = true
 
-				i, err := txn.Get([]byte(kst.fieldK()))
-				if err == badger.ErrKeyNotFound {
-					continue
-				}
-				if err != nil {
-					return fmt.Errorf("View: %w", err)
-				}
-
-				err = i.Value(func(v []byte) error {
-					x, err := fromBytes(v, t)
-					if err != nil {
-						return fmt.Errorf("Value: %w", err)
-					}
-
-					obj.FieldByName(f).Set(reflect.ValueOf(x))
-
-					return nil
-				})
-				if err != nil {
-					return fmt.Errorf("View: %w", err)
-				}
-			}
-
-			result = append(result, obj.Interface())
-		}
-
-		return nil
-	})
+	res, _, next, err := q.fetch(true)
 	if err != nil {
-		return nil, fmt.Errorf("Take: %w", err)
+		return nil, "", fmt.Errorf("Take: %w", err)
 	}
 
-	return result, nil
+	return res, next, nil
 }
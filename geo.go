@@ -0,0 +1,231 @@
+package slap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Point is a latitude and longitude in degrees
+// Fields tagged geo are indexed by interleaved cell hash
+type Point struct {
+	Lat float64
+	Lng float64
+}
+
+// Box is a latitude and longitude rectangle
+// MinLng above MaxLng crosses the antimeridian
+type Box struct {
+	MinLat float64
+	MinLng float64
+	MaxLat float64
+	MaxLng float64
+}
+
+// area is a geo condition, boxes bound candidates
+// Radius above zero also requires distance to center within it
+type area struct {
+	boxes  []Box
+	center Point
+	radius float64
+}
+
+const (
+	// mean earth radius in meters
+	_earth float64 = 6371008.8
+	// most cells scanned per box
+	_cells uint64 = 32
+)
+
+// Within matches records whose geo field lies in box
+func (q *Query) Within(field string, b Box) *Query {
+	if q.areas == nil {
+		q.areas = make(map[string]*area)
+	}
+	q.areas[field] = &area{boxes: []Box{b}}
+	return q
+}
+
+// Near matches records whose geo field lies within meters of center
+// Distances are great circle distances on a spherical earth
+func (q *Query) Near(field string, center Point, meters float64) *Query {
+	if q.areas == nil {
+		q.areas = make(map[string]*area)
+	}
+	q.areas[field] = &area{boxes: around(center, meters), center: center, radius: meters}
+	return q
+}
+
+// Distance returns great circle distance between points in meters
+func Distance(a, b Point) float64 {
+	la, lb := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dlat := lb - la
+	dlng := (b.Lng - a.Lng) * math.Pi / 180
+
+	h := math.Pow(math.Sin(dlat/2), 2) + math.Cos(la)*math.Cos(lb)*math.Pow(math.Sin(dlng/2), 2)
+	return 2 * _earth * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+func (b Box) contains(pt Point) bool {
+	if pt.Lat < b.MinLat || pt.Lat > b.MaxLat {
+		return false
+	}
+	if b.MinLng <= b.MaxLng {
+		return pt.Lng >= b.MinLng && pt.Lng <= b.MaxLng
+	}
+	return pt.Lng >= b.MinLng || pt.Lng <= b.MaxLng
+}
+
+// split breaks a box crossing the antimeridian in two
+func (b Box) split() []Box {
+	if b.MinLng <= b.MaxLng {
+		return []Box{b}
+	}
+
+	w, e := b, b
+	w.MaxLng = 180
+	e.MinLng = -180
+	return []Box{w, e}
+}
+
+func (a *area) contains(pt Point) bool {
+	for _, b := range a.boxes {
+		if b.contains(pt) {
+			return a.radius <= 0 || Distance(a.center, pt) <= a.radius
+		}
+	}
+
+	return false
+}
+
+// around bounds a circle with boxes
+// Circles reaching a pole span all longitudes
+func around(c Point, m float64) []Box {
+	d := m / _earth
+	lat := c.Lat * math.Pi / 180
+	b := Box{MinLat: c.Lat - d*180/math.Pi, MaxLat: c.Lat + d*180/math.Pi, MinLng: -180, MaxLng: 180}
+
+	if b.MinLat <= -90 || b.MaxLat >= 90 {
+		b.MinLat, b.MaxLat = math.Max(b.MinLat, -90), math.Min(b.MaxLat, 90)
+		return []Box{b}
+	}
+
+	s := math.Sin(d) / math.Cos(lat)
+	if s >= 1 {
+		return []Box{b}
+	}
+
+	dl := math.Asin(s) * 180 / math.Pi
+	b.MinLng, b.MaxLng = c.Lng-dl, c.Lng+dl
+	if b.MinLng < -180 {
+		b.MinLng += 360
+	}
+	if b.MaxLng > 180 {
+		b.MaxLng -= 360
+	}
+
+	return []Box{b}
+}
+
+// spans lists merged cell hash ranges covering area boxes
+func (a *area) spans() [][2]uint64 {
+	var rs [][2]uint64
+	for _, b := range a.boxes {
+		for _, x := range b.split() {
+			rs = append(rs, cover(x)...)
+		}
+	}
+
+	sort.Slice(rs, func(i, j int) bool {
+		return rs[i][0] < rs[j][0]
+	})
+
+	acc := [][2]uint64{}
+	for _, r := range rs {
+		n := len(acc)
+		if n > 0 && (r[0] <= acc[n-1][1] || r[0] == acc[n-1][1]+1) {
+			if r[1] > acc[n-1][1] {
+				acc[n-1][1] = r[1]
+			}
+			continue
+		}
+		acc = append(acc, r)
+	}
+
+	return acc
+}
+
+// cover picks the finest cell depth covering box in at most _cells cells
+func cover(b Box) [][2]uint64 {
+	x0, x1 := quant(b.MinLng, -180, 360), quant(b.MaxLng, -180, 360)
+	y0, y1 := quant(b.MinLat, -90, 180), quant(b.MaxLat, -90, 180)
+
+	m := uint(32)
+	for ; m > 0; m-- {
+		sh := 32 - m
+		nx, ny := x1>>sh-x0>>sh+1, y1>>sh-y0>>sh+1
+		if nx <= _cells && ny <= _cells && nx*ny <= _cells {
+			break
+		}
+	}
+
+	sh := 32 - m
+	rs := [][2]uint64{}
+	for ix := x0 >> sh; ix <= x1>>sh; ix++ {
+		for iy := y0 >> sh; iy <= y1>>sh; iy++ {
+			lo := interleave(ix, iy, m) << (64 - 2*m)
+			rs = append(rs, [2]uint64{lo, lo | (uint64(1)<<(64-2*m) - 1)})
+		}
+	}
+
+	return rs
+}
+
+// quant maps a coordinate onto 32 bits
+func quant(x, lo, span float64) uint64 {
+	f := (x - lo) / span * (1 << 32)
+	if f <= 0 {
+		return 0
+	}
+	if f >= 1<<32-1 {
+		return 1<<32 - 1
+	}
+	return uint64(f)
+}
+
+// interleave merges low m bits of x and y, x first
+func interleave(x, y uint64, m uint) uint64 {
+	var h uint64
+	for i := int(m) - 1; i >= 0; i-- {
+		h = h<<2 | (x>>uint(i)&1)<<1 | y>>uint(i)&1
+	}
+	return h
+}
+
+// geohash encodes a point as a sortable cell hash
+func geohash(pt Point) []byte {
+	h := interleave(quant(pt.Lng, -180, 360), quant(pt.Lat, -90, 180), 32)
+	bts := make([]byte, 8)
+	binary.BigEndian.PutUint64(bts, h)
+	return bts
+}
+
+// areas builds geo conditions on geo indexed fields
+func areas(s *shape, as map[string]*area) ([]pred, error) {
+	idx := s.indexed()
+	ps := []pred{}
+
+	for f, a := range as {
+		if idx[f] != _geo {
+			return nil, fmt.Errorf("areas: %s %w", f, ErrInvalidParameter)
+		}
+		ps = append(ps, pred{field: f, area: a})
+	}
+
+	sort.Slice(ps, func(i, j int) bool {
+		return ps[i].field < ps[j].field
+	})
+
+	return ps, nil
+}
@@ -3,7 +3,6 @@ module slap
 go 1.18
 
 require (
-	github.com/anhuret/gset v1.0.1
 	github.com/dgraph-io/badger/v3 v3.2103.2
 	github.com/rs/xid v1.3.0
 )
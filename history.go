@@ -0,0 +1,247 @@
+package slap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Change is a past state of a record
+// Record holds all fields after the change, zero for deletes
+// Fields names fields that differ from the previous state
+type Change struct {
+	Op      Op
+	Time    time.Time
+	Version uint64
+	Fields  []string
+	Record  interface{}
+}
+
+// snap is a stored record state, field values are kept encoded
+type snap struct {
+	Op      Op
+	Version uint64
+	Fields  []string
+	Values  map[string][]byte
+}
+
+// ReadAt retrieves record with given ID as it was at time at
+// Table must have history enabled, tag its ID field with history
+func (p *Store) ReadAt(table interface{}, id string, at time.Time) (interface{}, error) {
+	s, err := model(table, true)
+	if err != nil {
+		return nil, fmt.Errorf("ReadAt: %w", err)
+	}
+
+	if !s.history {
+		return nil, fmt.Errorf("ReadAt: %w", ErrInvalidParameter)
+	}
+
+	var x interface{}
+	err = p.db.View(func(txn *badger.Txn) error {
+		k := p.key(s.name)
+		k.id = id
+
+		ts, sn, err := p.latest(txn, k, at.UnixNano())
+		if err != nil {
+			return err
+		}
+		if ts == 0 || sn.Op == Deleted {
+			return ErrNoRecord
+		}
+
+		c, err := s.change(id, ts, sn)
+		if err != nil {
+			return err
+		}
+		x = c.Record
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ReadAt: %w", err)
+	}
+
+	return x, nil
+}
+
+// History lists changes of record with given ID, oldest first
+// Deleted records keep their history
+func (p *Store) History(table interface{}, id string) ([]Change, error) {
+	cs := []Change{}
+
+	s, err := model(table, true)
+	if err != nil {
+		return cs, fmt.Errorf("History: %w", err)
+	}
+
+	if !s.history {
+		return cs, fmt.Errorf("History: %w", ErrInvalidParameter)
+	}
+
+	k := p.key(s.name)
+	k.id = id
+	pfx := []byte(k.historyK(nil))
+
+	err = p.db.View(func(txn *badger.Txn) error {
+		itr := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer itr.Close()
+
+		for itr.Seek(pfx); itr.ValidForPrefix(pfx); itr.Next() {
+			ts, sn, err := unsnap(itr.Item(), len(pfx))
+			if err != nil {
+				return err
+			}
+
+			c, err := s.change(id, ts, sn)
+			if err != nil {
+				return err
+			}
+			cs = append(cs, c)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return []Change{}, fmt.Errorf("History: %w", err)
+	}
+
+	return cs, nil
+}
+
+// track stores current state of a record after op
+// Without force only records already having history are tracked
+func (p *Store) track(txn *badger.Txn, table, id string, op Op, force bool) error {
+	k := p.key(table)
+	k.id = id
+
+	ts := time.Now().UnixNano()
+	last, prev, err := p.latest(txn, k, math.MaxInt64)
+	if err != nil {
+		return fmt.Errorf("track: %w", err)
+	}
+	if last == 0 && !force {
+		return nil
+	}
+	if last >= ts {
+		ts = last + 1
+	}
+
+	sn := snap{Op: op, Fields: []string{}}
+
+	if op != Deleted {
+		i, err := txn.Get([]byte(k.recordK()))
+		if err != nil {
+			return fmt.Errorf("track: %w", err)
+		}
+
+		sn.Version, err = version(i)
+		if err != nil {
+			return fmt.Errorf("track: %w", err)
+		}
+
+		sn.Values, err = state(txn, k)
+		if err != nil {
+			return fmt.Errorf("track: %w", err)
+		}
+
+		sn.Fields = diff(prev.Values, sn.Values)
+	}
+
+	bts, err := toBytes(sn)
+	if err != nil {
+		return fmt.Errorf("track: %w", err)
+	}
+
+	err = txn.Set([]byte(k.historyK(ordinal(ts))), bts)
+	if err != nil {
+		return fmt.Errorf("track: %w", err)
+	}
+
+	return nil
+}
+
+// latest finds the last state of a record stored at or before ts
+// Returns zero time when there is none
+func (p *Store) latest(txn *badger.Txn, k *bow, ts int64) (int64, snap, error) {
+	pfx := []byte(k.historyK(nil))
+
+	ops := badger.DefaultIteratorOptions
+	ops.Reverse = true
+	itr := txn.NewIterator(ops)
+	defer itr.Close()
+
+	itr.Seek(append(pfx, ordinal(ts)...))
+	if !itr.ValidForPrefix(pfx) {
+		return 0, snap{}, nil
+	}
+
+	at, sn, err := unsnap(itr.Item(), len(pfx))
+	if err != nil {
+		return 0, snap{}, fmt.Errorf("latest: %w", err)
+	}
+
+	return at, sn, nil
+}
+
+// unsnap decodes a history entry whose time follows n key bytes
+func unsnap(i *badger.Item, n int) (int64, snap, error) {
+	var sn snap
+
+	key := i.Key()[n:]
+	if len(key) != 8 {
+		return 0, sn, fmt.Errorf("unsnap: %w", ErrMalformedKey)
+	}
+	ts := int64(binary.BigEndian.Uint64(key) ^ 1<<63)
+
+	err := i.Value(func(v []byte) error {
+		return gob.NewDecoder(bytes.NewReader(v)).Decode(&sn)
+	})
+	if err != nil {
+		return 0, sn, fmt.Errorf("unsnap: %w", err)
+	}
+
+	return ts, sn, nil
+}
+
+// change builds a Change from a stored state
+// Fields no longer in the model are skipped
+func (s *shape) change(id string, ts int64, sn snap) (Change, error) {
+	obj := reflect.New(s.cast).Elem()
+	obj.FieldByName("ID").Set(reflect.ValueOf(id))
+
+	if sn.Fields == nil {
+		sn.Fields = []string{}
+	}
+
+	if s.version != "" {
+		obj.FieldByName(s.version).SetUint(sn.Version)
+	}
+
+	for f, v := range sn.Values {
+		t, ok := s.fields[f]
+		if !ok {
+			continue
+		}
+
+		x, err := fromBytes(v, t)
+		if err != nil {
+			return Change{}, fmt.Errorf("change: %w", err)
+		}
+		obj.FieldByName(f).Set(reflect.ValueOf(x))
+	}
+
+	return Change{
+		Op:      sn.Op,
+		Time:    time.Unix(0, ts),
+		Version: sn.Version,
+		Fields:  sn.Fields,
+		Record:  obj.Interface(),
+	}, nil
+}
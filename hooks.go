@@ -0,0 +1,91 @@
+package slap
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Hooks are optional methods of model structs called within the
+// transaction of the operation, a returned error aborts it
+// Pointer receivers may change the record before it is written
+// Writes retried after a transaction conflict call hooks again
+
+// BeforeCreate is called before a record is written
+type BeforeCreate interface {
+	BeforeCreate(txn *badger.Txn) error
+}
+
+// AfterCreate is called after a record is written, its ID set
+type AfterCreate interface {
+	AfterCreate(txn *badger.Txn) error
+}
+
+// BeforeUpdate is called once per ID on a copy of the update values
+// ID is set, non zero fields are written, as are zero values given by
+// Increment and CompareAndSwap
+type BeforeUpdate interface {
+	BeforeUpdate(txn *badger.Txn) error
+}
+
+// AfterRead is called on each record read
+type AfterRead interface {
+	AfterRead(txn *badger.Txn) error
+}
+
+// BeforeDelete is called on the stored record before it is deleted
+// Records removed by cascades are not called
+type BeforeDelete interface {
+	BeforeDelete(txn *badger.Txn) error
+}
+
+// hook returns what obj methods can be called on, pointer if possible
+func hook(obj reflect.Value) interface{} {
+	if obj.CanAddr() {
+		return obj.Addr().Interface()
+	}
+	return obj.Interface()
+}
+
+// revise updates record id calling BeforeUpdate of data when defined
+// Shape and values are rebuilt from what the hook leaves, fields given
+// zero in v stay written unless the hook sets them
+func (p *Store) revise(txn *badger.Txn, data interface{}, s *shape, v vals, id string) error {
+	val := reflect.Indirect(reflect.ValueOf(data))
+	c := reflect.New(val.Type())
+
+	h, ok := c.Interface().(BeforeUpdate)
+	if !ok {
+		return p.update(txn, s, v, id)
+	}
+
+	c.Elem().Set(val)
+	c.Elem().FieldByName("ID").Set(reflect.ValueOf(id))
+
+	err := h.BeforeUpdate(txn)
+	if err != nil {
+		return fmt.Errorf("revise: %w", err)
+	}
+
+	r, err := model(c.Interface(), true)
+	if err != nil {
+		return fmt.Errorf("revise: %w", err)
+	}
+
+	fields := make(map[string]string)
+	for f, t := range r.fields {
+		x, given := v[f]
+		if !c.Elem().FieldByName(f).IsZero() || (given && reflect.ValueOf(x).IsZero()) {
+			fields[f] = t
+		}
+	}
+	r.fields = fields
+
+	v, err = r.values(c.Interface())
+	if err != nil {
+		return fmt.Errorf("revise: %w", err)
+	}
+
+	return p.update(txn, r, v, id)
+}
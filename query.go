@@ -0,0 +1,686 @@
+package slap
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Query collects select options
+// Built with Store.Query and executed with Run or Page
+type Query struct {
+	store   *Store
+	model   interface{}
+	fields  []string
+	joins   []string
+	order   []string
+	prefix  map[string]string
+	areas   map[string]*area
+	all     bool
+	deleted bool
+	span    Span
+	limit   int
+	cursor  string
+}
+
+// Query starts a query ANDing non zero values of x
+func (p *Store) Query(x interface{}) *Query {
+	return &Query{
+		store: p,
+		model: x,
+	}
+}
+
+// Fields limits fields read, same as Read filter
+func (q *Query) Fields(f ...string) *Query {
+	q.fields = append(q.fields, f...)
+	return q
+}
+
+// Include loads related records into join tagged fields
+// A join field is a struct or struct pointer tagged join=RefField
+func (q *Query) Include(f ...string) *Query {
+	q.joins = append(q.joins, f...)
+	return q
+}
+
+// Prefix matches records whose indexed string field starts with value
+// Fields tagged fold match case insensitively
+func (q *Query) Prefix(field, value string) *Query {
+	if q.prefix == nil {
+		q.prefix = make(map[string]string)
+	}
+	q.prefix[field] = value
+	return q
+}
+
+// Order sorts results by given fields, minus prefix sorts descending
+// Results are ordered by ID when no order is given
+// Ties are broken by ID in the direction of the first field
+func (q *Query) Order(f ...string) *Query {
+	q.order = append(q.order, f...)
+	return q
+}
+
+// Span bounds results by record position
+// Seek is the first record, excluded when Skip is set
+// End is the record results stop before
+// Reverse walks results backwards, by descending ID with no order
+type Span struct {
+	Seek    string
+	End     string
+	Skip    bool
+	Reverse bool
+}
+
+// Span sets result bounds
+func (q *Query) Span(sp Span) *Query {
+	q.span = sp
+	return q
+}
+
+// Limit caps the number of records returned
+func (q *Query) Limit(n int) *Query {
+	q.limit = n
+	return q
+}
+
+// After continues a query from a cursor returned by Page
+// Cursor is only valid with the same order and direction
+func (q *Query) After(cursor string) *Query {
+	q.cursor = cursor
+	return q
+}
+
+// Run executes the query
+// Returns slice of interfaces
+func (q *Query) Run() ([]interface{}, error) {
+	rec, _, _, err := q.fetch(false)
+	if err != nil {
+		return rec, fmt.Errorf("Run: %w", err)
+	}
+
+	return rec, nil
+}
+
+// Page executes the query returning at most Limit records
+// Returns cursor for the next page, empty when there is none
+func (q *Query) Page() ([]interface{}, string, error) {
+	rec, next, _, err := q.fetch(true)
+	if err != nil {
+		return rec, "", fmt.Errorf("Page: %w", err)
+	}
+
+	return rec, next, nil
+}
+
+// fetch runs the query, page peeks past the limit
+// Returns cursor and ID of the first record of the next page
+func (q *Query) fetch(page bool) ([]interface{}, string, string, error) {
+	rec := []interface{}{}
+	next, peek := "", ""
+
+	it, err := q.Iter()
+	if err != nil {
+		return rec, next, peek, fmt.Errorf("fetch: %w", err)
+	}
+	defer it.Close()
+
+	obs := []reflect.Value{}
+	last := ""
+
+	for {
+		obj, ok := it.next()
+		if !ok {
+			break
+		}
+		obs = append(obs, obj)
+		last = obj.FieldByName("ID").String()
+	}
+	if it.err != nil {
+		return rec, next, peek, fmt.Errorf("fetch: %w", it.err)
+	}
+
+	if page && q.limit > 0 && len(obs) == q.limit {
+		obj, more := it.scan()
+		if it.err != nil {
+			return rec, next, peek, fmt.Errorf("fetch: %w", it.err)
+		}
+		if more {
+			peek = obj.FieldByName("ID").String()
+			next, err = mark(it.txn, q.store, it.s.name, it.srt, last)
+			if err != nil {
+				return rec, next, peek, fmt.Errorf("fetch: %w", err)
+			}
+		}
+	}
+
+	err = q.store.joins(it.txn, it.js, obs, &rec)
+	if err != nil {
+		return []interface{}{}, "", "", fmt.Errorf("fetch: %w", err)
+	}
+
+	return rec, next, peek, nil
+}
+
+// Iterator streams query results from one read transaction
+// Memory stays bounded unless the order needs an in memory sort
+// Close must be called when done
+type Iterator struct {
+	q   *Query
+	txn *badger.Txn
+	w   *walk
+	s   *shape
+	srt []sorter
+	js  []join
+	val interface{}
+	err error
+	n   int
+}
+
+// Iter starts streaming query results
+func (q *Query) Iter() (*Iterator, error) {
+	val := reflect.Indirect(reflect.ValueOf(q.model)).Interface()
+
+	s, err := model(val, true)
+	if err != nil {
+		return nil, fmt.Errorf("Iter: %w", err)
+	}
+
+	err = q.store.reindex(s)
+	if err != nil {
+		return nil, fmt.Errorf("Iter: %w", err)
+	}
+	s.soft = s.soft && !q.deleted
+
+	srt, err := sorting(s, q.order)
+	if err != nil {
+		return nil, fmt.Errorf("Iter: %w", err)
+	}
+	if q.span.Reverse {
+		srt = reverse(srt)
+	}
+
+	after, err := q.after(srt)
+	if err != nil {
+		return nil, fmt.Errorf("Iter: %w", err)
+	}
+
+	js, err := q.plan(s)
+	if err != nil {
+		return nil, fmt.Errorf("Iter: %w", err)
+	}
+
+	txn := q.store.db.NewTransaction(false)
+
+	w, err := q.walk(txn, s, srt, val, after)
+	if err != nil {
+		txn.Discard()
+		return nil, fmt.Errorf("Iter: %w", err)
+	}
+
+	return &Iterator{
+		q:   q,
+		txn: txn,
+		w:   w,
+		s:   s,
+		srt: srt,
+		js:  js,
+	}, nil
+}
+
+// Next advances to the next record loading its joins
+// Returns false when done or on error
+func (it *Iterator) Next() bool {
+	obj, ok := it.next()
+	if !ok {
+		return false
+	}
+
+	rec := []interface{}{}
+	it.err = it.q.store.joins(it.txn, it.js, []reflect.Value{obj}, &rec)
+	if it.err != nil {
+		return false
+	}
+
+	it.val = rec[0]
+	return true
+}
+
+func (it *Iterator) next() (reflect.Value, bool) {
+	if it.q.limit > 0 && it.n >= it.q.limit {
+		return reflect.Value{}, false
+	}
+
+	obj, ok := it.scan()
+	if ok {
+		it.n++
+	}
+	return obj, ok
+}
+
+// scan loads the next record of the walk ignoring the limit
+// IDs whose record cannot be read are skipped
+func (it *Iterator) scan() (reflect.Value, bool) {
+	for it.err == nil && it.w != nil {
+		id, ok, err := it.w.next()
+		if err != nil {
+			it.err = err
+			break
+		}
+		if !ok {
+			break
+		}
+
+		obj, err := it.q.store.get(it.txn, it.s, id)
+		if errors.Is(err, ErrNoRecord) {
+			continue
+		}
+		if err != nil {
+			it.err = err
+			break
+		}
+
+		return obj, true
+	}
+
+	return reflect.Value{}, false
+}
+
+// Value returns current record
+func (it *Iterator) Value() interface{} {
+	return it.val
+}
+
+// Err returns error that stopped iteration
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the iterator and its transaction
+func (it *Iterator) Close() {
+	if it.w != nil {
+		it.w.close()
+		it.w = nil
+	}
+	it.txn.Discard()
+}
+
+// Iterate calls fn for each query result as it streams
+// Error returned by fn stops iteration and is returned
+func (p *Store) Iterate(q *Query, fn func(interface{}) error) error {
+	c := *q
+	c.store = p
+
+	it, err := c.Iter()
+	if err != nil {
+		return fmt.Errorf("Iterate: %w", err)
+	}
+	defer it.Close()
+
+	for it.Next() {
+		err = fn(it.Value())
+		if err != nil {
+			return err
+		}
+	}
+
+	if it.Err() != nil {
+		return fmt.Errorf("Iterate: %w", it.Err())
+	}
+
+	return nil
+}
+
+type cursor struct {
+	Order string
+	Key   []byte
+	ID    string
+}
+
+// after decodes query cursor
+func (q *Query) after(srt []sorter) (*cursor, error) {
+	if q.cursor == "" {
+		return nil, nil
+	}
+
+	bts, err := base64.RawURLEncoding.DecodeString(q.cursor)
+	if err != nil {
+		return nil, fmt.Errorf("after: %w", ErrInvalidCursor)
+	}
+
+	var c cursor
+	err = gob.NewDecoder(bytes.NewReader(bts)).Decode(&c)
+	if err != nil || c.Order != signature(srt) || c.ID == "" {
+		return nil, fmt.Errorf("after: %w", ErrInvalidCursor)
+	}
+
+	return &c, nil
+}
+
+// mark encodes cursor positioned at record id
+func mark(txn *badger.Txn, p *Store, table string, srt []sorter, id string) (string, error) {
+	c := cursor{Order: signature(srt), ID: id}
+
+	if !byID(srt) {
+		key, err := p.composite(txn, table, srt, id)
+		if err != nil {
+			return "", fmt.Errorf("mark: %w", err)
+		}
+		c.Key = key
+	}
+
+	bts, err := toBytes(c)
+	if err != nil {
+		return "", fmt.Errorf("mark: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(bts), nil
+}
+
+type sorter struct {
+	field string
+	typ   string
+	desc  bool
+}
+
+// sorting parses order keys against table shape
+func sorting(s *shape, keys []string) ([]sorter, error) {
+	var srt []sorter
+	idx := s.indexed()
+
+	for _, k := range keys {
+		o := sorter{field: strings.TrimPrefix(k, "-")}
+		o.desc = o.field != k
+
+		if o.field != "ID" {
+			t, ok := s.fields[o.field]
+			if !ok || zero(t) == nil {
+				return nil, fmt.Errorf("sorting: %s %w", o.field, ErrInvalidParameter)
+			}
+			o.typ = t
+			if c, ok := idx[o.field]; ok {
+				o.typ = c
+			}
+		}
+
+		srt = append(srt, o)
+	}
+
+	return srt, nil
+}
+
+// reverse flips sort directions, no order becomes descending ID
+func reverse(srt []sorter) []sorter {
+	if len(srt) == 0 {
+		return []sorter{{field: "ID", desc: true}}
+	}
+
+	rev := make([]sorter, len(srt))
+	for i, o := range srt {
+		o.desc = !o.desc
+		rev[i] = o
+	}
+
+	return rev
+}
+
+// signature names effective order, cursors are only valid for the same
+func signature(srt []sorter) string {
+	sig := []string{}
+	for _, o := range srt {
+		if o.desc {
+			sig = append(sig, "-"+o.field)
+		} else {
+			sig = append(sig, o.field)
+		}
+	}
+
+	return strings.Join(sig, ",")
+}
+
+// composite builds a record sort key from sort field index encodings
+func (p *Store) composite(txn *badger.Txn, table string, srt []sorter, id string) ([]byte, error) {
+	var c []byte
+
+	for _, o := range srt {
+		key, err := p.sortval(txn, table, o, id)
+		if err != nil {
+			return nil, fmt.Errorf("composite: %w", err)
+		}
+
+		if o.desc {
+			key = invert(key)
+		}
+		c = append(c, key...)
+	}
+
+	if srt[0].desc {
+		return append(c, invert([]byte(id))...), nil
+	}
+
+	return append(c, id...), nil
+}
+
+// sortval reads index encoding of a record sort field
+// Missing fields sort as zero values
+func (p *Store) sortval(txn *badger.Txn, table string, o sorter, id string) ([]byte, error) {
+	if o.field == "ID" {
+		return []byte(id), nil
+	}
+
+	k := p.key(table)
+	k.id = id
+
+	_, err := txn.Get([]byte(k.recordK()))
+	if err == badger.ErrKeyNotFound {
+		return nil, fmt.Errorf("sortval: %w", ErrNoRecord)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sortval: %w", err)
+	}
+
+	k.field = o.field
+	i, err := txn.Get([]byte(k.fieldK()))
+	if err == badger.ErrKeyNotFound {
+		return toKey(zero(o.typ))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sortval: %w", err)
+	}
+
+	var key []byte
+	err = i.Value(func(v []byte) error {
+		key, err = indexKey(v, o.typ)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("sortval: %w", err)
+	}
+
+	return key, nil
+}
+
+type join struct {
+	field string
+	ref   string
+	cast  *shape
+	ptr   bool
+}
+
+// plan applies field filter and resolves included joins
+// Reference fields backing joins are always read
+func (q *Query) plan(s *shape) ([]join, error) {
+	var js []join
+	ftr := append([]string{}, q.fields...)
+
+	for _, f := range q.joins {
+		r, ok := s.joins[f]
+		if !ok {
+			return nil, fmt.Errorf("plan: %s %w", f, ErrInvalidParameter)
+		}
+		if _, ok := s.refs[r]; !ok {
+			return nil, fmt.Errorf("plan: %s %w", r, ErrInvalidParameter)
+		}
+
+		fld, _ := s.cast.FieldByName(f)
+		typ := fld.Type
+		ptr := typ.Kind() == reflect.Ptr
+		if ptr {
+			typ = typ.Elem()
+		}
+		if typ.Name() != s.refs[r].table {
+			return nil, fmt.Errorf("plan: %s %w", f, ErrInvalidParameter)
+		}
+
+		c, err := model(reflect.New(typ).Interface(), true)
+		if err != nil {
+			return nil, fmt.Errorf("plan: %w", err)
+		}
+
+		js = append(js, join{field: f, ref: r, cast: c, ptr: ptr})
+		if len(ftr) != 0 {
+			ftr = append(ftr, r)
+		}
+	}
+
+	s.filter(ftr)
+
+	return js, nil
+}
+
+// joins loads included records and collects results
+func (p *Store) joins(txn *badger.Txn, js []join, obs []reflect.Value, rec *[]interface{}) error {
+	for _, j := range js {
+		err := p.join(txn, j, obs)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, o := range obs {
+		*rec = append(*rec, o.Interface())
+	}
+
+	return nil
+}
+
+// join batch reads records referenced by obs and sets join field
+// Each referenced record is read once
+func (p *Store) join(txn *badger.Txn, j join, obs []reflect.Value) error {
+	got := make(map[string]reflect.Value)
+
+	for _, o := range obs {
+		id := o.FieldByName(j.ref).String()
+		if id == "" {
+			continue
+		}
+
+		r, ok := got[id]
+		if !ok {
+			x, err := p.get(txn, j.cast, id)
+			if errors.Is(err, ErrNoRecord) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("join: %w", err)
+			}
+			r = x
+			got[id] = r
+		}
+
+		fld := o.FieldByName(j.field)
+		if j.ptr {
+			c := reflect.New(r.Type())
+			c.Elem().Set(r)
+			fld.Set(c)
+		} else {
+			fld.Set(r)
+		}
+	}
+
+	return nil
+}
+
+// Count returns number of records matching query
+// Order, span, cursor and limit are ignored, no field values are decoded
+func (p *Store) Count(q *Query) (int, error) {
+	n := 0
+	val := reflect.Indirect(reflect.ValueOf(q.model)).Interface()
+
+	s, err := model(val, true)
+	if err != nil {
+		return n, fmt.Errorf("Count: %w", err)
+	}
+
+	err = p.reindex(s)
+	if err != nil {
+		return n, fmt.Errorf("Count: %w", err)
+	}
+
+	c := q.cond(p, val)
+
+	err = p.db.View(func(txn *badger.Txn) error {
+		w, err := c.walk(txn, s, nil, val, nil)
+		if err != nil {
+			return err
+		}
+		defer w.close()
+
+		for {
+			_, ok, err := w.next()
+			if err != nil || !ok {
+				return err
+			}
+			n++
+		}
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Count: %w", err)
+	}
+
+	return n, nil
+}
+
+// cond copies query conditions leaving out order, bounds and projection
+func (q *Query) cond(p *Store, val interface{}) *Query {
+	return &Query{store: p, model: val, prefix: q.prefix, areas: q.areas, all: q.all, deleted: q.deleted}
+}
+
+// Exists reports whether record with given ID exists in table
+func (p *Store) Exists(table interface{}, id string) (bool, error) {
+	s, err := model(table, true)
+	if err != nil {
+		return false, fmt.Errorf("Exists: %w", err)
+	}
+
+	k := p.key(s.name)
+	k.id = id
+
+	err = p.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(k.recordK()))
+		if err != nil || !s.soft {
+			return err
+		}
+
+		gone, err := p.deleted(txn, s.name, id)
+		if gone {
+			return badger.ErrKeyNotFound
+		}
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Exists: %w", err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,206 @@
+package slap
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// referrer is stored against referenced table for each reference field
+// Index lets cascades clean referrer records without their struct,
+// Types lets the audit log decode their values, Audit tells it is audited
+type referrer struct {
+	Rule  string
+	Index map[string]string
+	Types map[string]string
+	Audit bool
+}
+
+// link validates reference fields and records them against referenced tables
+// Zero references are not checked, soft deleted records cannot be referenced
+func (p *Store) link(txn *badger.Txn, s *shape, v vals) error {
+	if len(s.refs) == 0 {
+		return nil
+	}
+
+	full, err := model(reflect.New(s.cast).Interface(), true)
+	if err != nil {
+		return fmt.Errorf("link: %w", err)
+	}
+
+	for f, r := range s.refs {
+		if _, ok := s.fields[f]; !ok {
+			continue
+		}
+
+		k := p.key(r.table)
+
+		meta, err := toBytes(referrer{Rule: r.rule, Index: full.indexed(), Types: full.fields, Audit: full.audit})
+		if err != nil {
+			return fmt.Errorf("link: %w", err)
+		}
+
+		i, err := txn.Get([]byte(k.refK(s.name, f)))
+		if err != nil && err != badger.ErrKeyNotFound {
+			return fmt.Errorf("link: %w", err)
+		}
+
+		same := false
+		if err == nil {
+			err = i.Value(func(v []byte) error {
+				same = bytes.Equal(v, meta)
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("link: %w", err)
+			}
+		}
+
+		if !same {
+			err = txn.Set([]byte(k.refK(s.name, f)), meta)
+			if err != nil {
+				return fmt.Errorf("link: %w", err)
+			}
+		}
+
+		id, _ := v[f].(string)
+		if id == "" {
+			continue
+		}
+
+		k.id = id
+		_, err = txn.Get([]byte(k.recordK()))
+		if err == badger.ErrKeyNotFound {
+			return fmt.Errorf("link: %s %w", f, ErrNoReference)
+		}
+		if err != nil {
+			return fmt.Errorf("link: %w", err)
+		}
+
+		// only soft delete tables have tombstones
+		gone, err := p.deleted(txn, r.table, id)
+		if err != nil {
+			return fmt.Errorf("link: %w", err)
+		}
+		if gone {
+			return fmt.Errorf("link: %s %w", f, ErrNoReference)
+		}
+	}
+
+	return nil
+}
+
+// unlink applies reference rules to records pointing at table record id
+// Restrict fails, cascade erases the referrer, setnull clears its field
+// Referrers in seen are being erased already or later in the batch
+func (p *Store) unlink(txn *badger.Txn, table, id string, seen map[string]bool) error {
+	type source struct {
+		table string
+		field string
+		referrer
+	}
+
+	var refs []source
+	pfx := []byte(strings.Join([]string{_refSchema, p.schema, table, ""}, ":"))
+
+	itr := txn.NewIterator(badger.DefaultIteratorOptions)
+	for itr.Seek(pfx); itr.ValidForPrefix(pfx); itr.Next() {
+		part := strings.Split(string(itr.Item().Key()[len(pfx):]), ":")
+		if len(part) != 2 {
+			continue
+		}
+
+		err := itr.Item().Value(func(v []byte) error {
+			var r referrer
+			err := gob.NewDecoder(bytes.NewReader(v)).Decode(&r)
+			if err != nil {
+				return err
+			}
+			refs = append(refs, source{part[0], part[1], r})
+			return nil
+		})
+		if err != nil {
+			itr.Close()
+			return fmt.Errorf("unlink: %w", err)
+		}
+	}
+	itr.Close()
+
+	key, err := toKey(id)
+	if err != nil {
+		return fmt.Errorf("unlink: %w", err)
+	}
+
+	for _, r := range refs {
+		k := p.key(r.table)
+		k.field = r.field
+
+		for _, ik := range prefixed(txn, []byte(k.stubK(key))) {
+			k.id = ik[strings.LastIndex(ik, ":")+1:]
+			if _, ok := seen[k.recordK()]; ok {
+				continue
+			}
+
+			switch r.Rule {
+			case _cascade:
+				_, err = p.erase(txn, r.table, r.Index, r.Types, r.Audit, k.id, seen)
+			case _setnull:
+				err = p.nullify(txn, k, ik, r.Audit)
+			default:
+				err = fmt.Errorf("%s.%s %w", r.table, r.field, ErrReferenced)
+			}
+			if err != nil {
+				return fmt.Errorf("unlink: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// nullify resets reference field to zero value, zero values are not stored
+// Written keys keep the record expiry, record version is bumped
+// Audit tells whether the referrer table is audited
+func (p *Store) nullify(txn *badger.Txn, k *bow, ik string, audit bool) error {
+	i, err := txn.Get([]byte(k.recordK()))
+	if err != nil {
+		return fmt.Errorf("nullify: %w", err)
+	}
+	exp := i.ExpiresAt()
+
+	before, err := p.prior(txn, audit, k.table, k.id)
+	if err != nil {
+		return fmt.Errorf("nullify: %w", err)
+	}
+
+	n, err := version(i)
+	if err != nil {
+		return fmt.Errorf("nullify: %w", err)
+	}
+
+	err = put(txn, []byte(k.recordK()), marker(n+1, Updated), exp)
+	if err != nil {
+		return fmt.Errorf("nullify: %w", err)
+	}
+
+	err = txn.Delete([]byte(ik))
+	if err != nil {
+		return fmt.Errorf("nullify: %w", err)
+	}
+
+	err = txn.Delete([]byte(k.fieldK()))
+	if err != nil {
+		return fmt.Errorf("nullify: %w", err)
+	}
+
+	err = p.track(txn, k.table, k.id, Updated, false)
+	if err != nil {
+		return fmt.Errorf("nullify: %w", err)
+	}
+
+	return p.log(txn, audit, k.table, k.id, Updated, map[string]string{k.field: "string"}, before)
+}
@@ -2,18 +2,39 @@ package slap
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"fmt"
+	"math"
 	"reflect"
 	"strings"
 	"time"
 )
 
 type shape struct {
-	cast   reflect.Type
-	name   string
-	fields map[string]string
-	index  map[string]null
+	cast    reflect.Type
+	name    string
+	fields  map[string]string
+	index   map[string]null
+	fold    map[string]null
+	geo     map[string]null
+	text    map[string]string
+	vector  map[string]null
+	ttl     string
+	version string
+	history bool
+	soft    bool
+	audit   bool
+	created string
+	updated string
+	rules   map[string][]rule
+	refs    map[string]ref
+	joins   map[string]string
+}
+
+type ref struct {
+	table string
+	rule  string
 }
 
 func model(x interface{}, z bool) (*shape, error) {
@@ -29,34 +50,245 @@ func model(x interface{}, z bool) (*shape, error) {
 	typ := val.Type()
 	fields := make(map[string]string)
 	index := make(map[string]null)
+	fold := make(map[string]null)
+	geo := make(map[string]null)
+	text := make(map[string]string)
+	vector := make(map[string]null)
+	ttl := ""
+	version := ""
+	history := false
+	soft := false
+	audit := false
+	stamps := map[string]string{_created: "", _updated: ""}
+	checks := make(map[string][]rule)
+	refs := make(map[string]ref)
+	joins := make(map[string]string)
 
 	for i := 0; i < typ.NumField(); i++ {
 		f := typ.Field(i)
+		opt := tags(f)
+
+		if _, ok := opt[_history]; ok {
+			if f.Name != "ID" {
+				return nil, fmt.Errorf("model: %s %w", f.Name, ErrInvalidParameter)
+			}
+			history = true
+		}
+
+		if _, ok := opt[_soft]; ok {
+			if f.Name != "ID" {
+				return nil, fmt.Errorf("model: %s %w", f.Name, ErrInvalidParameter)
+			}
+			soft = true
+		}
+
+		if _, ok := opt[_audit]; ok {
+			if f.Name != "ID" {
+				return nil, fmt.Errorf("model: %s %w", f.Name, ErrInvalidParameter)
+			}
+			audit = true
+		}
+
+		for o := range stamps {
+			if _, ok := opt[o]; !ok {
+				continue
+			}
+			if stamps[o] != "" || f.Type.String() != "time.Time" {
+				return nil, fmt.Errorf("model: %s %w", f.Name, ErrInvalidParameter)
+			}
+			stamps[o] = f.Name
+		}
+
+		if r, ok := opt["join"]; ok {
+			joins[f.Name] = r
+			continue
+		}
+
+		if _, ok := opt[_version]; ok {
+			if version != "" || f.Type.Kind() != reflect.Uint64 {
+				return nil, fmt.Errorf("model: %s %w", f.Name, ErrInvalidParameter)
+			}
+			version = f.Name
+			continue
+		}
 
 		if !z && val.Field(i).IsZero() {
+			// updated stamps are added by update, their index kept for it
+			if _, ok := opt["index"]; ok && f.Name == stamps[_updated] {
+				index[f.Name] = void
+			}
 			continue
 		}
 		fields[f.Name] = val.Field(i).Type().String()
 
-		if f.Tag.Get("slap") == "index" {
+		rs, err := cached(typ, f, fields[f.Name])
+		if err != nil {
+			return nil, fmt.Errorf("model: %s %w", f.Name, err)
+		}
+		if len(rs) > 0 {
+			checks[f.Name] = rs
+		}
+
+		if _, ok := opt["index"]; ok {
 			index[f.Name] = void
 		}
+
+		if t, ok := opt["ref"]; ok {
+			r, err := reference(t, opt, fields[f.Name])
+			if err != nil {
+				return nil, fmt.Errorf("model: %w", err)
+			}
+			refs[f.Name] = r
+			index[f.Name] = void
+		}
+
+		if _, ok := opt[_fold]; ok {
+			_, isref := refs[f.Name]
+			if fields[f.Name] != "string" || isref {
+				return nil, fmt.Errorf("model: %s %w", f.Name, ErrInvalidParameter)
+			}
+			fold[f.Name] = void
+			index[f.Name] = void
+		}
+
+		if _, ok := opt[_geo]; ok {
+			if fields[f.Name] != _point {
+				return nil, fmt.Errorf("model: %s %w", f.Name, ErrInvalidParameter)
+			}
+			geo[f.Name] = void
+			index[f.Name] = void
+		}
+
+		if m, ok := opt[_text]; ok {
+			if fields[f.Name] != "string" || (m != "" && m != _stem) {
+				return nil, fmt.Errorf("model: %s %w", f.Name, ErrInvalidParameter)
+			}
+			text[f.Name] = m
+		}
+
+		if _, ok := opt[_vector]; ok {
+			if fields[f.Name] != "[]float32" {
+				return nil, fmt.Errorf("model: %s %w", f.Name, ErrInvalidParameter)
+			}
+			vector[f.Name] = void
+		}
+
+		if _, ok := opt[_ttl]; ok {
+			t := f.Type.String()
+			if ttl != "" || (t != "time.Duration" && t != "time.Time") {
+				return nil, fmt.Errorf("model: %s %w", f.Name, ErrInvalidParameter)
+			}
+			ttl = f.Name
+		}
 	}
 
 	if _, ok := fields["ID"]; ok {
 		delete(fields, "ID")
 	}
+	delete(checks, "ID")
 
 	s := shape{
-		cast:   typ,
-		name:   typ.Name(),
-		fields: fields,
-		index:  index,
+		cast:    typ,
+		name:    typ.Name(),
+		fields:  fields,
+		index:   index,
+		fold:    fold,
+		geo:     geo,
+		text:    text,
+		vector:  vector,
+		ttl:     ttl,
+		version: version,
+		history: history,
+		soft:    soft,
+		audit:   audit,
+		created: stamps[_created],
+		updated: stamps[_updated],
+		rules:   checks,
+		refs:    refs,
+		joins:   joins,
 	}
 
 	return &s, nil
 }
 
+// options lists known slap tag options
+var options = map[string]null{
+	"index": void, "ref": void, "join": void,
+	_restrict: void, _cascade: void, _setnull: void,
+	_fold: void, _geo: void, _text: void, _vector: void,
+	_ttl: void, _version: void, _history: void, _soft: void, _audit: void,
+	_created: void, _updated: void,
+	_required: void, _min: void, _max: void, _len: void, _regexp: void, _oneof: void,
+}
+
+// tags parses comma separated slap tag options
+// Options may carry a value as in ref=Customer
+// Commas in a regexp value are kept unless followed by a known option
+func tags(f reflect.StructField) map[string]string {
+	opt := make(map[string]string)
+	last := ""
+
+	for _, seg := range strings.Split(f.Tag.Get("slap"), ",") {
+		t := strings.TrimSpace(seg)
+		k, v, _ := strings.Cut(t, "=")
+
+		if _, ok := options[k]; last == _regexp && !ok {
+			opt[last] += "," + seg
+			continue
+		}
+
+		if t == "" {
+			continue
+		}
+		opt[k] = v
+		last = k
+	}
+
+	return opt
+}
+
+// reference builds a ref from tag options
+// Reference fields hold string IDs, restrict is the default rule
+func reference(table string, opt map[string]string, typ string) (ref, error) {
+	if table == "" || typ != "string" {
+		return ref{}, ErrInvalidParameter
+	}
+
+	r := ref{table: table, rule: _restrict}
+	n := 0
+	for _, rule := range []string{_restrict, _cascade, _setnull} {
+		if _, ok := opt[rule]; ok {
+			r.rule = rule
+			n++
+		}
+	}
+	if n > 1 {
+		return ref{}, ErrInvalidParameter
+	}
+
+	return r, nil
+}
+
+// indexed maps indexed fields to their index codecs
+// Codec is the field type, fold for case folded strings or geo for points
+func (s *shape) indexed() map[string]string {
+	idx := make(map[string]string)
+
+	for f := range s.index {
+		if t, ok := s.fields[f]; ok {
+			idx[f] = t
+			if _, ok := s.fold[f]; ok {
+				idx[f] = _fold
+			}
+			if _, ok := s.geo[f]; ok {
+				idx[f] = _geo
+			}
+		}
+	}
+
+	return idx
+}
+
 func (s *shape) values(x interface{}) (vals, error) {
 	val := reflect.Indirect(reflect.ValueOf(x))
 	if val.Kind() != reflect.Struct {
@@ -93,11 +325,72 @@ func (b *bow) tableK() string {
 }
 
 func (b *bow) indexK(v []byte) string {
-	return strings.Join([]string{_indexSchema, b.table, b.field, string(v), b.id}, ":")
+	return strings.Join([]string{_indexSchema, b.schema, b.table, b.field, string(v), b.id}, ":")
 }
 
 func (b *bow) stubK(v []byte) string {
-	return strings.Join([]string{_indexSchema, b.table, b.field, string(v), ""}, ":")
+	return strings.Join([]string{_indexSchema, b.schema, b.table, b.field, string(v), ""}, ":")
+}
+
+// legacyK is the index key of b.field written before index keys held
+// the schema and ordered encodings, v is the stored field value
+func (b *bow) legacyK(v []byte) string {
+	return strings.Join([]string{_indexSchema, b.table, b.field, string(v), b.id}, ":")
+}
+
+// formatK holds the index format of b.table
+func (b *bow) formatK() string {
+	return strings.Join([]string{_formatSchema, b.schema, b.table}, ":")
+}
+
+// indexT prefixes index keys of b.table
+func (b *bow) indexT() string {
+	return strings.Join([]string{_indexSchema, b.schema, b.table, ""}, ":")
+}
+
+// indexF prefixes index keys of b.field
+func (b *bow) indexF() string {
+	return strings.Join([]string{_indexSchema, b.schema, b.table, b.field, ""}, ":")
+}
+
+// textK is a posting of term in field of record b.id
+func (b *bow) textK(term string) string {
+	return strings.Join([]string{_textSchema, b.schema, b.table, b.field, term, b.id}, ":")
+}
+
+// docK holds terms and length of a record text field
+func (b *bow) docK() string {
+	return strings.Join([]string{_docSchema, b.schema, b.table, b.id, b.field}, ":")
+}
+
+// statK holds document count and total length of a text field
+func (b *bow) statK() string {
+	return strings.Join([]string{_statSchema, b.schema, b.table, b.field}, ":")
+}
+
+// vectorK places record b.id in a hash bucket of field
+func (b *bow) vectorK(bucket string) string {
+	return strings.Join([]string{_vectorSchema, b.schema, b.table, b.field, bucket, b.id}, ":")
+}
+
+// vecdocK holds hash buckets of a record vector field
+func (b *bow) vecdocK() string {
+	return strings.Join([]string{_vecdocSchema, b.schema, b.table, b.id, b.field}, ":")
+}
+
+// historyK holds record state at encoded time ts
+func (b *bow) historyK(ts []byte) string {
+	return strings.Join([]string{_histSchema, b.schema, b.table, b.id, string(ts)}, ":")
+}
+
+// deletedK marks record b.id soft deleted
+func (b *bow) deletedK() string {
+	return strings.Join([]string{_deletedSchema, b.schema, b.table, b.id}, ":")
+}
+
+// refK records that field of table t references b.table
+func (b *bow) refK(t, f string) string {
+	return strings.Join([]string{_refSchema, b.schema, b.table, t, f}, ":")
 }
 
 func toBytes(x interface{}) ([]byte, error) {
@@ -166,11 +459,218 @@ func fromBytes(bts []byte, t string) (interface{}, error) {
 			return nil, fmt.Errorf("fromBytes: %w", err)
 		}
 		return x, nil
+	case "time.Duration":
+		var x time.Duration
+		err := dec.Decode(&x)
+		if err != nil {
+			return nil, fmt.Errorf("fromBytes: %w", err)
+		}
+		return x, nil
+	case "[]float32":
+		var x []float32
+		err := dec.Decode(&x)
+		if err != nil {
+			return nil, fmt.Errorf("fromBytes: %w", err)
+		}
+		return x, nil
+	case _point:
+		var x Point
+		err := dec.Decode(&x)
+		if err != nil {
+			return nil, fmt.Errorf("fromBytes: %w", err)
+		}
+		return x, nil
 	default:
 		return nil, fmt.Errorf("fromBytes: %w", ErrTypeConversion)
 	}
 }
 
+// toKey encodes index values preserving their order
+// Strings are escaped and terminated so no encoding is a prefix of another
+func toKey(x interface{}) ([]byte, error) {
+	switch v := x.(type) {
+	case string:
+		return escape([]byte(v)), nil
+	case []byte:
+		return escape(v), nil
+	case int:
+		return ordinal(int64(v)), nil
+	case int64:
+		return ordinal(v), nil
+	case float64:
+		b := math.Float64bits(v)
+		if v < 0 || (v == 0 && math.Signbit(v)) {
+			b = ^b
+		} else {
+			b ^= 1 << 63
+		}
+		bts := make([]byte, 8)
+		binary.BigEndian.PutUint64(bts, b)
+		return bts, nil
+	case bool:
+		if v {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case time.Time:
+		bts := make([]byte, 12)
+		copy(bts, ordinal(v.Unix()))
+		binary.BigEndian.PutUint32(bts[8:], uint32(v.Nanosecond()))
+		return bts, nil
+	case Point:
+		return geohash(v), nil
+	default:
+		return nil, fmt.Errorf("toKey: %w", ErrTypeConversion)
+	}
+}
+
+// toIndex encodes an index value with the codec of its field
+// Folded strings are lower cased first
+func toIndex(x interface{}, t string) ([]byte, error) {
+	if v, ok := x.(string); ok && t == _fold {
+		x = strings.ToLower(v)
+	}
+
+	return toKey(x)
+}
+
+// fromKey decodes index values produced by toKey
+func fromKey(bts []byte, t string) (interface{}, error) {
+	switch t {
+	case "string", "[]uint8", _fold:
+		b, err := unescape(bts)
+		if err != nil {
+			return nil, fmt.Errorf("fromKey: %w", err)
+		}
+		if t == "[]uint8" {
+			return b, nil
+		}
+		return string(b), nil
+	case "bool":
+		if len(bts) != 1 {
+			return nil, fmt.Errorf("fromKey: %w", ErrTypeConversion)
+		}
+		return bts[0] == 1, nil
+	case "time.Time":
+		if len(bts) != 12 {
+			return nil, fmt.Errorf("fromKey: %w", ErrTypeConversion)
+		}
+		sec := int64(binary.BigEndian.Uint64(bts) ^ 1<<63)
+		return time.Unix(sec, int64(binary.BigEndian.Uint32(bts[8:]))), nil
+	case "int", "int64", "float64":
+		if len(bts) != 8 {
+			return nil, fmt.Errorf("fromKey: %w", ErrTypeConversion)
+		}
+		u := binary.BigEndian.Uint64(bts)
+		switch t {
+		case "int":
+			return int(int64(u ^ 1<<63)), nil
+		case "int64":
+			return int64(u ^ 1<<63), nil
+		}
+		if u&(1<<63) != 0 {
+			u ^= 1 << 63
+		} else {
+			u = ^u
+		}
+		return math.Float64frombits(u), nil
+	default:
+		return nil, fmt.Errorf("fromKey: %w", ErrTypeConversion)
+	}
+}
+
+// indexKey converts a stored field value into its index encoding
+func indexKey(bts []byte, t string) ([]byte, error) {
+	typ := t
+	switch t {
+	case _fold:
+		typ = "string"
+	case _geo:
+		typ = _point
+	}
+
+	x, err := fromBytes(bts, typ)
+	if err != nil {
+		return nil, fmt.Errorf("indexKey: %w", err)
+	}
+
+	return toIndex(x, t)
+}
+
+func ordinal(i int64) []byte {
+	bts := make([]byte, 8)
+	binary.BigEndian.PutUint64(bts, uint64(i)^1<<63)
+	return bts
+}
+
+func escape(b []byte) []byte {
+	bts := make([]byte, 0, len(b)+2)
+	for _, c := range b {
+		bts = append(bts, c)
+		if c == 0 {
+			bts = append(bts, 0xff)
+		}
+	}
+	return append(bts, 0, 1)
+}
+
+func unescape(b []byte) ([]byte, error) {
+	bts := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] != 0 {
+			bts = append(bts, b[i])
+			continue
+		}
+		if i+1 >= len(b) {
+			return nil, ErrTypeConversion
+		}
+		switch b[i+1] {
+		case 0xff:
+			bts = append(bts, 0)
+			i++
+		case 1:
+			if i+2 != len(b) {
+				return nil, ErrTypeConversion
+			}
+			return bts, nil
+		default:
+			return nil, ErrTypeConversion
+		}
+	}
+	return nil, ErrTypeConversion
+}
+
+// invert flips bytes so ascending encodings sort descending
+func invert(b []byte) []byte {
+	bts := make([]byte, len(b))
+	for i, c := range b {
+		bts[i] = ^c
+	}
+	return bts
+}
+
+// zero returns zero value of a supported field type
+func zero(t string) interface{} {
+	switch t {
+	case "string", _fold:
+		return ""
+	case "[]uint8":
+		return []byte{}
+	case "int":
+		return 0
+	case "int64":
+		return int64(0)
+	case "float64":
+		return 0.0
+	case "bool":
+		return false
+	case "time.Time":
+		return time.Time{}
+	default:
+		return nil
+	}
+}
+
 func (s *shape) filter(f []string) {
 	if len(f) == 0 {
 		return
@@ -1,10 +1,21 @@
 package slap
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
 	"errors"
+	"fmt"
+	"math"
+	"math/rand"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/dgraph-io/badger/v3"
 )
 
 func TestCrud(t *testing.T) {
@@ -268,6 +279,19 @@ func TestCrud(t *testing.T) {
 		if res[0].(some).ID != id[0] {
 			t.Error("invalid field update")
 		}
+
+		err = piv.Update(&some{Address: "Jersey St"}, id[0])
+		if err != nil {
+			t.Error(err)
+		}
+
+		res, err = piv.Select(&some{Address: "Jersey St"}, []string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != 1 {
+			t.Error("same value update should keep index")
+		}
 	})
 
 	t.Run("test delete", func(t *testing.T) {
@@ -287,10 +311,16 @@ func TestCrud(t *testing.T) {
 			t.Error("invalid field read")
 		}
 
-		err = piv.Delete(&some{}, id[0])
+		rem, mis, err := piv.Delete(&some{}, id[0], "nothing")
 		if err != nil {
 			t.Fatal(err)
 		}
+		if len(rem) != 1 || rem[0] != id[0] {
+			t.Error("wrong removed IDs")
+		}
+		if len(mis) != 1 || mis[0] != "nothing" {
+			t.Error("wrong missing IDs")
+		}
 
 		res, err = piv.Read(&some{}, []string{}, id[0])
 		if !errors.Is(err, ErrNoRecord) {
@@ -302,6 +332,24 @@ func TestCrud(t *testing.T) {
 		if len(res) != 0 {
 			t.Fatal("res should have 0 element")
 		}
+
+		ids, err := piv.Create(&sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = piv.Atomic().Delete(&some{}, ids...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rep, err := piv.Check(&some{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rep.Clean() || rep.Indexes != 0 || rep.Records != 0 || rep.Fields != 0 {
+			t.Error("index keyspace should be clean", rep)
+		}
 	})
 
 	t.Run("test model", func(t *testing.T) {
@@ -537,7 +585,7 @@ func TestTake(t *testing.T) {
 	var res []interface{}
 	for i := 1; i < 6; i++ {
 
-		res, err = piv.Take(&tmc{}, []string{"Name", "Count"}, "", i)
+		res, _, err = piv.Take(&tmc{}, []string{"Name", "Count"}, Span{}, i)
 
 		if err != nil {
 			t.Error(err)
@@ -562,7 +610,7 @@ func TestTake(t *testing.T) {
 
 	limit := 2
 	id := res[limit].(tmc).ID
-	res, err = piv.Take(&tmc{}, []string{}, id, limit)
+	res, _, err = piv.Take(&tmc{}, []string{}, Span{Seek: id}, limit)
 	for i, r := range res {
 		s := r.(tmc)
 		if s.Name != "Ruslan" {
@@ -575,5 +623,3230 @@ func TestTake(t *testing.T) {
 			t.Error("skip/limit error")
 		}
 	}
-	t.Log(res)
+
+	all, next, err := piv.Take(&tmc{}, []string{}, Span{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 5 || next != "" {
+		t.Fatal("take all should not return next")
+	}
+
+	res, next, err = piv.Take(&tmc{}, []string{}, Span{}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != all[2].(tmc).ID {
+		t.Error("next should be first record of next page")
+	}
+
+	res, next, err = piv.Take(&tmc{}, []string{}, Span{Seek: next}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0].(tmc).Count != 3 || next != all[4].(tmc).ID {
+		t.Error("next page should continue at seek")
+	}
+
+	res, _, err = piv.Take(&tmc{}, []string{}, Span{Seek: all[1].(tmc).ID, Skip: true, End: all[4].(tmc).ID}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0].(tmc).Count != 3 || res[1].(tmc).Count != 4 {
+		t.Error("exclusive seek and end bound error", res)
+	}
+
+	res, next, err = piv.Take(&tmc{}, []string{}, Span{Reverse: true}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 3 || res[0].(tmc).Count != 5 || res[2].(tmc).Count != 3 || next != all[1].(tmc).ID {
+		t.Error("reverse take error", res)
+	}
+
+	res, _, err = piv.Take(&tmc{}, []string{}, Span{Seek: next, Reverse: true, End: all[0].(tmc).ID}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].(tmc).Count != 2 {
+		t.Error("reverse seek and end bound error", res)
+	}
+
+	res, _, err = piv.Take(&tmc{}, []string{}, Span{Seek: all[3].(tmc).ID, Reverse: true}, 0, "Count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 4 || res[0].(tmc).Count != 4 || res[3].(tmc).Count != 1 {
+		t.Error("reverse ordered take error", res)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type chk struct {
+		ID   string
+		Name string `slap:"index"`
+		Age  int    `slap:"index"`
+		Note string
+	}
+
+	arr := []chk{
+		{Name: "Ruslan", Age: 46, Note: "one"},
+		{Name: "Tom", Age: 25, Note: "two"},
+		{Name: "Jim", Age: 60, Note: "three"},
+	}
+
+	ids, err := piv.Create(&arr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := piv.Check(&chk{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.Clean() {
+		t.Fatal("fresh store should be clean", rep.Faults)
+	}
+	if rep.Records != 3 || rep.Fields != 9 || rep.Indexes != 6 {
+		t.Error("wrong key counts", rep.Records, rep.Fields, rep.Indexes)
+	}
+
+	k := piv.key("chk")
+	err = piv.WithDB(func(db *badger.DB) error {
+		return db.Update(func(txn *badger.Txn) error {
+			k.id = ids[0]
+			err := txn.Delete([]byte(k.recordK()))
+			if err != nil {
+				return err
+			}
+
+			k.id, k.field = ids[1], "Name"
+			key, _ := toKey("Tom")
+			err = txn.Delete([]byte(k.indexK(key)))
+			if err != nil {
+				return err
+			}
+
+			k.id, k.field = ids[2], "Note"
+			return txn.Set([]byte(k.fieldK()), []byte("garbage"))
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err = piv.Check(chk{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := map[Issue]int{}
+	for _, f := range rep.Faults {
+		count[f.Issue]++
+	}
+	if count[OrphanField] != 3 {
+		t.Error("wrong orphan field count", count[OrphanField])
+	}
+	if count[OrphanIndex] != 2 {
+		t.Error("wrong orphan index count", count[OrphanIndex])
+	}
+	if count[MissingIndex] != 1 {
+		t.Error("wrong missing index count", count[MissingIndex])
+	}
+	if count[BadValue] != 1 {
+		t.Error("wrong bad value count", count[BadValue])
+	}
+
+	rep, err = piv.Repair(&chk{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Fixed != 6 {
+		t.Error("wrong fixed count", rep.Fixed)
+	}
+
+	rep, err = piv.Check(&chk{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Faults) != 1 || rep.Faults[0].Issue != BadValue {
+		t.Error("only bad value should remain", rep.Faults)
+	}
+	if rep.Records != 2 || rep.Indexes != 4 {
+		t.Error("wrong key counts after repair", rep.Records, rep.Indexes)
+	}
+
+	res, err := piv.Select(&chk{Name: "Tom"}, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 {
+		t.Error("repaired index should be found")
+	}
+
+	beta := *piv
+	beta.schema = "beta"
+	_, err = beta.Create(&chk{Name: "Tom"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err = piv.Repair(&chk{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Fixed != 0 {
+		t.Error("other schema should be left alone", rep.Faults)
+	}
+
+	res, err = beta.Select(&chk{Name: "Tom"}, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 {
+		t.Error("other schema index should be kept", len(res))
+	}
+}
+
+func TestCheckKinds(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type kind struct {
+		ID   string
+		Emb  []float32     `slap:"vector"`
+		Life time.Duration `slap:"ttl"`
+	}
+
+	_, err := piv.Create(&kind{Emb: []float32{1, 2}, Life: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := piv.Check(&kind{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.Clean() || rep.Fields != 2 {
+		t.Error("vector and ttl fields should decode", rep.Fields, rep.Faults)
+	}
+}
+
+func TestReindex(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type old struct {
+		ID   string
+		Name string `slap:"index"`
+		Age  int    `slap:"index"`
+	}
+
+	ids, err := piv.Create(&[]old{{Name: "Tom", Age: 25}, {Name: "Zed"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := piv.Check(&old{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Fields != 3 || rep.Indexes != 3 {
+		t.Error("zero values should not be stored", rep.Fields, rep.Indexes)
+	}
+
+	res, err := piv.Select(&old{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Error("zero struct should select none", len(res))
+	}
+
+	k := piv.key("old")
+	k.id, k.field = ids[0], "Age"
+	legacy := ""
+	err = piv.WithDB(func(db *badger.DB) error {
+		return db.Update(func(txn *badger.Txn) error {
+			bts, _ := toBytes(25)
+			legacy = k.legacyK(bts)
+			key, _ := toKey(25)
+			err := txn.Delete([]byte(k.indexK(key)))
+			if err != nil {
+				return err
+			}
+
+			err = txn.Set([]byte(legacy), []byte{0})
+			if err != nil {
+				return err
+			}
+
+			return txn.Delete([]byte(k.formatK()))
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = piv.Select(&old{Age: 25}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 {
+		t.Error("outdated index should be rebuilt", len(res))
+	}
+
+	err = piv.WithDB(func(db *badger.DB) error {
+		return db.View(func(txn *badger.Txn) error {
+			_, err := txn.Get([]byte(legacy))
+			return err
+		})
+	})
+	if !errors.Is(err, badger.ErrKeyNotFound) {
+		t.Error("legacy index entry should be removed", err)
+	}
+
+	rep, err = piv.Check(&old{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.Clean() {
+		t.Error("reindexed table should be clean", rep.Faults)
+	}
+}
+
+func TestRef(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type Customer struct {
+		ID   string
+		Name string
+	}
+
+	type Order struct {
+		ID         string
+		CustomerID string `slap:"ref=Customer,cascade"`
+		Total      float64
+	}
+
+	type Line struct {
+		ID      string
+		OrderID string `slap:"ref=Order"`
+		Item    string
+	}
+
+	type Note struct {
+		ID         string
+		CustomerID string `slap:"ref=Customer,setnull"`
+		Text       string
+	}
+
+	_, err := piv.Create(&Order{CustomerID: "nobody", Total: 1})
+	if !errors.Is(err, ErrNoReference) {
+		t.Fatal("must return correct error", err)
+	}
+
+	cid, err := piv.Create(&Customer{Name: "Jim"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oid, err := piv.Create(&Order{CustomerID: cid[0], Total: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = piv.Update(&Order{CustomerID: "nobody"}, oid[0])
+	if !errors.Is(err, ErrNoReference) {
+		t.Fatal("must return correct error", err)
+	}
+
+	nid, err := piv.Create(&Note{CustomerID: cid[0], Text: "call back"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lid, err := piv.Create(&Line{OrderID: oid[0], Item: "tea"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = piv.Delete(&Customer{}, cid[0])
+	if !errors.Is(err, ErrReferenced) {
+		t.Fatal("line should restrict cascading delete", err)
+	}
+
+	res, err := piv.Read(&Order{}, []string{}, oid[0])
+	if err != nil || len(res) != 1 {
+		t.Fatal("failed delete should leave order in place", err)
+	}
+
+	rem, _, err := piv.Delete(&Line{}, lid[0])
+	if err != nil || len(rem) != 1 {
+		t.Fatal(err)
+	}
+
+	rem, _, err = piv.Delete(&Customer{}, cid[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rem) != 1 {
+		t.Fatal("customer should be removed")
+	}
+
+	_, err = piv.Read(&Order{}, []string{}, oid[0])
+	if !errors.Is(err, ErrNoRecord) {
+		t.Error("order should be cascaded", err)
+	}
+
+	res, err = piv.Read(&Note{}, []string{}, nid[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0].(Note).CustomerID != "" || res[0].(Note).Text != "call back" {
+		t.Error("note reference should be cleared", res[0])
+	}
+
+	for _, x := range []interface{}{&Customer{}, &Order{}, &Line{}, &Note{}} {
+		rep, err := piv.Check(x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rep.Clean() {
+			t.Error("store should be clean", rep.Faults)
+		}
+	}
+
+	type Bad struct {
+		ID    string
+		Owner int `slap:"ref=Customer"`
+	}
+
+	_, err = piv.Create(&Bad{Owner: 1})
+	if !errors.Is(err, ErrInvalidParameter) {
+		t.Error("must return correct error", err)
+	}
+
+	type Node struct {
+		ID     string
+		Parent string `slap:"ref=Node"`
+	}
+
+	top, err := piv.Create(&Node{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := piv.Create(&Node{Parent: top[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = piv.Delete(&Node{}, top[0], sub[0])
+	if !errors.Is(err, ErrReferenced) {
+		t.Error("separate deletes should restrict", err)
+	}
+
+	removed, _, err := piv.Atomic().Delete(&Node{}, top[0], sub[0])
+	if err != nil {
+		t.Fatal("batch should resolve its own references", err)
+	}
+	if len(removed) != 2 {
+		t.Error("both nodes should be removed", removed)
+	}
+}
+
+func TestRefSchema(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+	other := &Store{db: piv.db, schema: "other"}
+
+	type Customer struct {
+		ID   string
+		Name string
+	}
+
+	var cids [2][]string
+	for i, st := range []*Store{piv, other} {
+		ids, err := st.Create(&Customer{Name: st.schema})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cids[i] = ids
+	}
+
+	{
+		type Order struct {
+			ID         string
+			CustomerID string `slap:"ref=Customer,cascade"`
+		}
+		_, err := piv.Create(&Order{CustomerID: cids[0][0]})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	{
+		type Order struct {
+			ID         string
+			CustomerID string `slap:"ref=Customer,restrict"`
+		}
+		_, err := other.Create(&Order{CustomerID: cids[1][0]})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, _, err := piv.Delete(&Customer{}, cids[0]...)
+	if err != nil || len(removed) != 1 {
+		t.Error("cascade rule of own schema should apply", err)
+	}
+
+	_, _, err = other.Delete(&Customer{}, cids[1]...)
+	if !errors.Is(err, ErrReferenced) {
+		t.Error("restrict rule of other schema should be kept", err)
+	}
+}
+
+func TestInclude(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type Customer struct {
+		ID   string
+		Name string
+	}
+
+	type Order struct {
+		ID         string
+		CustomerID string    `slap:"ref=Customer"`
+		Status     string    `slap:"index"`
+		Customer   *Customer `slap:"join=CustomerID"`
+	}
+
+	type Invoice struct {
+		ID         string
+		CustomerID string   `slap:"ref=Customer"`
+		Customer   Customer `slap:"join=CustomerID"`
+	}
+
+	cid, err := piv.Create(&[]Customer{{Name: "Jim"}, {Name: "Tom"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = piv.Create(&[]Order{
+		{CustomerID: cid[0], Status: "open"},
+		{CustomerID: cid[0], Status: "open"},
+		{CustomerID: cid[1], Status: "open"},
+		{Status: "open"},
+		{CustomerID: cid[1], Status: "closed"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := piv.Query(&Order{Status: "open"}).Fields("Status").Include("Customer").Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 4 {
+		t.Fatal("res should have 4 elements")
+	}
+
+	names := map[string]int{}
+	for _, r := range res {
+		o := r.(Order)
+		if o.CustomerID == "" {
+			if o.Customer != nil {
+				t.Error("zero reference should not be loaded")
+			}
+			continue
+		}
+		if o.Customer == nil || o.Customer.ID != o.CustomerID {
+			t.Fatal("customer should be loaded")
+		}
+		names[o.Customer.Name]++
+	}
+	if names["Jim"] != 2 || names["Tom"] != 1 {
+		t.Error("wrong customers loaded", names)
+	}
+
+	res, err = piv.Select(&Order{Status: "closed"}, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].(Order).Customer != nil {
+		t.Error("customer should not be loaded without include")
+	}
+
+	_, err = piv.Create(&Invoice{CustomerID: cid[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = piv.Query(&Invoice{CustomerID: cid[1]}).Include("Customer").Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].(Invoice).Customer.Name != "Tom" {
+		t.Error("customer should be loaded by value")
+	}
+
+	_, err = piv.Query(&Order{Status: "open"}).Include("Status").Run()
+	if !errors.Is(err, ErrInvalidParameter) {
+		t.Error("must return correct error", err)
+	}
+}
+
+func TestOrder(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type srt struct {
+		ID    string
+		Group string `slap:"index"`
+		Name  string
+		Age   int     `slap:"index"`
+		Money float64 `slap:"index"`
+	}
+
+	arr := []srt{
+		{Group: "a", Name: "Tom", Age: 46, Money: -1.5},
+		{Group: "a", Name: "Jim", Age: 0, Money: 10},
+		{Group: "a", Name: "Ann", Age: 46, Money: 0},
+		{Group: "b", Name: "Bob", Age: -3, Money: 2.25},
+		{Group: "a", Name: "Zoe", Age: 120, Money: -100},
+	}
+
+	_, err := piv.Create(&arr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(res []interface{}) string {
+		s := []string{}
+		for _, r := range res {
+			s = append(s, r.(srt).Name)
+		}
+		return strings.Join(s, ",")
+	}
+
+	res, err := piv.Query(&srt{}).Order("Age", "Name").Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names(res) != "Bob,Jim,Ann,Tom,Zoe" {
+		t.Error("wrong multi key order", names(res))
+	}
+
+	res, err = piv.Select(&srt{Group: "a"}, []string{}, "-Money")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names(res) != "Jim,Ann,Tom,Zoe" {
+		t.Error("wrong indexed descending order", names(res))
+	}
+
+	res, err = piv.Select(&srt{Group: "a"}, []string{"Name"}, "-Name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names(res) != "Zoe,Tom,Jim,Ann" {
+		t.Error("wrong descending order", names(res))
+	}
+
+	res, err = piv.Query(&srt{}).Order("Money").Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names(res) != "Zoe,Tom,Ann,Bob,Jim" {
+		t.Error("wrong indexed order", names(res))
+	}
+
+	res, _, err = piv.Take(&srt{}, []string{}, Span{}, 0, "-Age", "Name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names(res) != "Zoe,Ann,Tom,Jim,Bob" {
+		t.Error("wrong take order", names(res))
+	}
+
+	seek := res[2].(srt).ID
+	res, _, err = piv.Take(&srt{}, []string{}, Span{Seek: seek}, 2, "-Age", "Name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names(res) != "Tom,Jim" {
+		t.Error("wrong take seek order", names(res))
+	}
+
+	res, _, err = piv.Take(&srt{}, []string{}, Span{Seek: seek}, 2, "Money")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names(res) != "Tom,Ann" {
+		t.Error("wrong indexed take seek order", names(res))
+	}
+
+	res, _, err = piv.Take(&srt{}, []string{}, Span{}, 0, "-ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(res); i++ {
+		if res[i-1].(srt).ID <= res[i].(srt).ID {
+			t.Error("wrong descending ID order")
+		}
+	}
+
+	_, err = piv.Query(&srt{}).Order("Nothing").Run()
+	if !errors.Is(err, ErrInvalidParameter) {
+		t.Error("must return correct error", err)
+	}
+}
+
+func TestKeyEncoding(t *testing.T) {
+	vals := [][]interface{}{
+		{-1 << 40, -7, 0, 1, 42, 1 << 40},
+		{int64(-9), int64(0), int64(3)},
+		{-1e9, -2.5, -0.25, 0.0, 1e-9, 3.5, 1e9},
+		{"", "\x00", "\x00a", "a", "a\x00", "ab", "b"},
+		{false, true},
+		{time.Time{}, time.Unix(-10, 0), time.Unix(-10, 5), time.Unix(0, 0), time.Now(), time.Date(2500, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, vs := range vals {
+		var prev []byte
+		for i, v := range vs {
+			key, err := toKey(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i > 0 && bytes.Compare(prev, key) >= 0 {
+				t.Error("order not preserved", vs[i-1], v)
+			}
+			if i > 0 && bytes.Compare(invert(prev), invert(key)) <= 0 {
+				t.Error("inverted order not reversed", vs[i-1], v)
+			}
+			prev = key
+
+			x, err := fromKey(key, reflect.TypeOf(v).String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tm, ok := v.(time.Time); ok {
+				if !tm.Equal(x.(time.Time)) {
+					t.Error("invalid conversion", v, x)
+				}
+				continue
+			}
+			if !reflect.DeepEqual(v, x) {
+				t.Error("invalid conversion", v, x)
+			}
+		}
+	}
+}
+
+func TestExtremeOrder(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type ext struct {
+		ID   string
+		Name string
+		N    int64   `slap:"index"`
+		F    float64 `slap:"index"`
+	}
+
+	_, err := piv.Create(&[]ext{
+		{Name: "max", N: math.MaxInt64, F: math.Inf(1)},
+		{Name: "min", N: math.MinInt64, F: math.Inf(-1)},
+		{Name: "mid", N: 7, F: 2.5},
+		{Name: "top", N: math.MaxInt64, F: math.MaxFloat64},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(res []interface{}) string {
+		s := []string{}
+		for _, r := range res {
+			s = append(s, r.(ext).Name)
+		}
+		return strings.Join(s, ",")
+	}
+
+	res, err := piv.Query(&ext{}).Order("-F").Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names(res) != "max,top,mid,min" {
+		t.Error("wrong descending order of extreme floats", names(res))
+	}
+
+	res, err = piv.Query(&ext{}).Order("-N").Limit(2).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0].(ext).N != math.MaxInt64 || res[1].(ext).N != math.MaxInt64 {
+		t.Error("descending walk should start at the largest int", names(res))
+	}
+
+	res, err = piv.Query(&ext{N: math.MaxInt64}).Order("-ID").Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0].(ext).ID < res[1].(ext).ID {
+		t.Error("descending ID walk should find the largest int", names(res))
+	}
+
+	res, err = piv.Query(&ext{}).Order("N").Limit(1).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].(ext).Name != "min" {
+		t.Error("ascending walk should start at the smallest int", names(res))
+	}
+}
+
+func TestPage(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type pg struct {
+		ID    string
+		Group string `slap:"index"`
+		Name  string
+		Rank  int `slap:"index"`
+	}
+
+	arr := []pg{}
+	for i := 0; i < 11; i++ {
+		arr = append(arr, pg{Group: []string{"x", "y"}[i%2], Name: fmt.Sprintf("n%02d", i%4), Rank: i % 3})
+	}
+
+	_, err := piv.Create(&arr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, order := range [][]string{{}, {"-ID"}, {"-Rank"}, {"Rank"}, {"Name", "-Rank"}} {
+		for _, x := range []pg{{}, {Group: "x"}, {Group: "y", Name: "n01"}} {
+			all, err := piv.Query(&x).Order(order...).Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := []interface{}{}
+			cur := ""
+			for i := 0; ; i++ {
+				res, next, err := piv.Query(&x).Order(order...).Limit(3).After(cur).Page()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(res) > 3 {
+					t.Fatal("page exceeds limit")
+				}
+				got = append(got, res...)
+				if next == "" {
+					break
+				}
+				if i > len(all) {
+					t.Fatal("paging does not end")
+				}
+				cur = next
+			}
+
+			if !reflect.DeepEqual(all, got) {
+				t.Error("pages should add up to full result", order, x)
+			}
+		}
+	}
+
+	res, err := piv.Select(&pg{Name: "n01"}, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 3 {
+		t.Error("non indexed condition should match", len(res))
+	}
+
+	_, next, err := piv.Query(&pg{}).Order("Rank").Limit(2).Page()
+	if err != nil || next == "" {
+		t.Fatal("should return next cursor", err)
+	}
+
+	_, _, err = piv.Query(&pg{}).Order("-Rank").Limit(2).After(next).Page()
+	if !errors.Is(err, ErrInvalidCursor) {
+		t.Error("must return correct error", err)
+	}
+
+	_, _, err = piv.Query(&pg{}).After("garbage").Page()
+	if !errors.Is(err, ErrInvalidCursor) {
+		t.Error("must return correct error", err)
+	}
+}
+
+func TestIterate(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type Customer struct {
+		ID   string
+		Name string
+	}
+
+	type Order struct {
+		ID         string
+		CustomerID string    `slap:"ref=Customer"`
+		Status     string    `slap:"index"`
+		Total      int       `slap:"index"`
+		Customer   *Customer `slap:"join=CustomerID"`
+	}
+
+	cid, err := piv.Create(&Customer{Name: "Jim"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	arr := []Order{}
+	for i := 0; i < 50; i++ {
+		arr = append(arr, Order{CustomerID: cid[0], Status: []string{"open", "closed"}[i%2], Total: i})
+	}
+
+	_, err = piv.Create(&arr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := piv.Query(&Order{Status: "open"}).Order("-Total").Include("Customer").Iter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, prev := 0, 100
+	for it.Next() {
+		o := it.Value().(Order)
+		if o.Status != "open" || o.Total >= prev {
+			t.Error("wrong streamed record", o)
+		}
+		if o.Customer == nil || o.Customer.Name != "Jim" {
+			t.Error("customer should be loaded")
+		}
+		prev = o.Total
+		n++
+	}
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+	it.Close()
+
+	if n != 25 {
+		t.Error("wrong streamed count", n)
+	}
+
+	sum := 0
+	err = piv.Iterate(piv.Query(&Order{}).Limit(10), func(x interface{}) error {
+		sum += x.(Order).Total
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 45 {
+		t.Error("wrong limited iteration", sum)
+	}
+
+	stop := errors.New("stop")
+	n = 0
+	err = piv.Iterate(piv.Query(&Order{}), func(x interface{}) error {
+		n++
+		if n == 3 {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) || n != 3 {
+		t.Error("callback error should stop iteration", err)
+	}
+}
+
+func TestCount(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type cnt struct {
+		ID    string
+		Group string `slap:"index"`
+		Name  string
+		Age   int `slap:"index"`
+	}
+
+	arr := []cnt{}
+	for i := 0; i < 20; i++ {
+		arr = append(arr, cnt{Group: []string{"a", "b", "c", "d"}[i%4], Name: []string{"x", "y"}[i%2], Age: i % 5})
+	}
+
+	ids, err := piv.Create(&arr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		x cnt
+		n int
+	}{
+		{cnt{}, 20},
+		{cnt{Group: "a"}, 5},
+		{cnt{Group: "a", Name: "x"}, 5},
+		{cnt{Group: "b", Name: "x"}, 0},
+		{cnt{Name: "y"}, 10},
+		{cnt{Age: 3}, 4},
+		{cnt{Group: "d", Age: 3}, 1},
+	} {
+		n, err := piv.Count(piv.Query(&c.x))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != c.n {
+			t.Error("wrong count", c.x, n)
+		}
+
+		res, err := piv.Query(&c.x).Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != n {
+			t.Error("count should match query", c.x)
+		}
+	}
+
+	ok, err := piv.Exists(&cnt{}, ids[3])
+	if err != nil || !ok {
+		t.Error("record should exist", err)
+	}
+
+	_, _, err = piv.Delete(&cnt{}, ids[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err = piv.Exists(cnt{}, ids[3])
+	if err != nil || ok {
+		t.Error("record should not exist", err)
+	}
+
+	n, err := piv.Count(piv.Query(&cnt{Group: "d"}))
+	if err != nil || n != 4 {
+		t.Error("count should drop deleted record", n, err)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type agg struct {
+		ID    string
+		Group string `slap:"index"`
+		Name  string
+		Age   int `slap:"index"`
+		Money float64
+	}
+
+	arr := []agg{}
+	for i := 0; i < 12; i++ {
+		arr = append(arr, agg{Group: []string{"a", "b", "c"}[i%3], Name: []string{"x", "y"}[i%2], Age: i + 10, Money: float64(i) * 1.5})
+	}
+
+	_, err := piv.Create(&arr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := piv.Aggregate(piv.Query(&agg{}), "Age")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Count != 12 || res[0].Sum != 186 || res[0].Min != 10 || res[0].Max != 21 || res[0].Avg != 15.5 {
+		t.Error("wrong totals", res)
+	}
+
+	res, err = piv.Aggregate(piv.Query(&agg{}), "Money", "Group", "Name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 6 {
+		t.Fatal("wrong group count", len(res))
+	}
+	if !reflect.DeepEqual(res[0].Group, []interface{}{"a", "x"}) || res[0].Count != 2 || res[0].Sum != 9 || res[0].Min != 0 || res[0].Max != 9 {
+		t.Error("wrong first group", res[0])
+	}
+	if !reflect.DeepEqual(res[5].Group, []interface{}{"c", "y"}) || res[5].Count != 2 || res[5].Sum != 24 {
+		t.Error("wrong last group", res[5])
+	}
+
+	res, err = piv.Aggregate(piv.Query(&agg{Name: "y"}), "Age", "Group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 3 || res[1].Group[0] != "b" || res[1].Count != 2 || res[1].Avg != 14 {
+		t.Error("wrong filtered groups", res)
+	}
+
+	_, err = piv.Aggregate(piv.Query(&agg{}), "Name")
+	if !errors.Is(err, ErrInvalidParameter) {
+		t.Error("non numeric field should fail", err)
+	}
+
+	for _, c := range []struct {
+		q     agg
+		field string
+		min   interface{}
+		max   interface{}
+	}{
+		{agg{}, "Age", 10, 21},
+		{agg{Group: "b"}, "Age", 11, 20},
+		{agg{Name: "x"}, "Money", 0.0, 15.0},
+		{agg{Group: "c"}, "Name", "x", "y"},
+	} {
+		min, ok, err := piv.Min(piv.Query(&c.q), c.field)
+		if err != nil || !ok || min != c.min {
+			t.Error("wrong min", c.q, c.field, min, err)
+		}
+
+		max, ok, err := piv.Max(piv.Query(&c.q), c.field)
+		if err != nil || !ok || max != c.max {
+			t.Error("wrong max", c.q, c.field, max, err)
+		}
+	}
+
+	_, ok, err := piv.Min(piv.Query(&agg{Group: "z"}), "Age")
+	if err != nil || ok {
+		t.Error("empty result should have no min", err)
+	}
+
+	_, err = piv.Create(&[]agg{{Group: "big", Age: math.MaxInt64}, {Group: "big", Age: 1 << 62}, {Group: "neg", Age: -3}, {Group: "neg"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		q   agg
+		max interface{}
+	}{
+		{agg{}, math.MaxInt64},
+		{agg{Group: "big"}, math.MaxInt64},
+		{agg{Group: "neg"}, 0},
+	} {
+		max, ok, err := piv.Max(piv.Query(&c.q), "Age")
+		if err != nil || !ok || max != c.max {
+			t.Error("wrong max of large values", c.q, max, err)
+		}
+	}
+}
+
+func TestDistinct(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type dst struct {
+		ID    string
+		Group string `slap:"index"`
+		Age   int    `slap:"index"`
+		Name  string
+	}
+
+	arr := []dst{}
+	for i := 0; i < 15; i++ {
+		arr = append(arr, dst{Group: []string{"b:x", "a", "c", "a", "b:x"}[i%5], Age: i%3 - 1, Name: "n"})
+	}
+
+	_, err := piv.Create(&arr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, next, err := piv.Distinct(dst{}, "Group", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != "" {
+		t.Error("cursor should be empty when done")
+	}
+	if !reflect.DeepEqual(res, []Distinct{{"a", 6}, {"b:x", 6}, {"c", 3}}) {
+		t.Error("wrong distinct values", res)
+	}
+
+	res, _, err = piv.Distinct(&dst{}, "Age", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, []Distinct{{-1, 5}, {1, 5}}) {
+		t.Error("wrong distinct ints", res)
+	}
+
+	acc := []Distinct{}
+	next = ""
+	for {
+		res, next, err = piv.Distinct(dst{}, "Group", next, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		acc = append(acc, res...)
+		if next == "" {
+			break
+		}
+	}
+	if !reflect.DeepEqual(acc, []Distinct{{"a", 6}, {"b:x", 6}, {"c", 3}}) {
+		t.Error("wrong paged values", acc)
+	}
+
+	_, _, err = piv.Distinct(dst{}, "Name", "", 0)
+	if !errors.Is(err, ErrInvalidParameter) {
+		t.Error("non indexed field should fail", err)
+	}
+
+	_, _, err = piv.Distinct(dst{}, "Group", "!", 0)
+	if !errors.Is(err, ErrInvalidCursor) {
+		t.Error("bad cursor should fail", err)
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type pfx struct {
+		ID    string
+		Name  string `slap:"index"`
+		Nick  string `slap:"fold"`
+		Group string `slap:"index"`
+		Note  string
+	}
+
+	arr := []pfx{
+		{Name: "John", Nick: "JOHNNY", Group: "a", Note: "x"},
+		{Name: "Joan", Nick: "jo", Group: "b", Note: "x"},
+		{Name: "Bob", Nick: "Bobby", Group: "a", Note: "y"},
+		{Name: "Jo", Nick: "Joey", Group: "a", Note: "y"},
+		{Name: "jon", Nick: "J\x00o", Group: "b", Note: "x"},
+		{Name: "Ann", Group: "b"},
+	}
+
+	ids, err := piv.Create(&arr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(res []interface{}) []string {
+		acc := []string{}
+		for _, r := range res {
+			acc = append(acc, r.(pfx).Name)
+		}
+		return acc
+	}
+
+	for _, c := range []struct {
+		q   *Query
+		out []string
+	}{
+		{piv.Query(&pfx{}).Prefix("Name", "Jo"), []string{"John", "Joan", "Jo"}},
+		{piv.Query(&pfx{}).Prefix("Name", "Jo").Order("Name"), []string{"Jo", "Joan", "John"}},
+		{piv.Query(&pfx{}).Prefix("Name", "Jo").Order("-Name"), []string{"John", "Joan", "Jo"}},
+		{piv.Query(&pfx{}).Prefix("Name", "Jo").Span(Span{Reverse: true}), []string{"Jo", "Joan", "John"}},
+		{piv.Query(&pfx{Group: "a"}).Prefix("Name", "Jo"), []string{"John", "Jo"}},
+		{piv.Query(&pfx{Note: "x"}).Prefix("Name", "J"), []string{"John", "Joan"}},
+		{piv.Query(&pfx{}).Prefix("Nick", "JO"), []string{"John", "Joan", "Jo"}},
+		{piv.Query(&pfx{}).Prefix("Nick", "j\x00"), []string{"jon"}},
+		{piv.Query(&pfx{}).Prefix("Nick", "bob").Prefix("Name", "B"), []string{"Bob"}},
+		{piv.Query(&pfx{}).Prefix("Name", "Jo").Order("Group", "Name"), []string{"Jo", "John", "Joan"}},
+		{piv.Query(&pfx{}).Prefix("Name", "Z"), []string{}},
+		{piv.Query(&pfx{Nick: "jOhNnY"}), []string{"John"}},
+		{piv.Query(&pfx{}).Order("Nick").Limit(3), []string{"Ann", "Bob", "jon"}},
+	} {
+		res, err := c.q.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(names(res), c.out) {
+			t.Error("wrong prefix results", names(res), c.out)
+		}
+	}
+
+	n, err := piv.Count(piv.Query(&pfx{}).Prefix("Nick", "jo"))
+	if err != nil || n != 3 {
+		t.Error("wrong prefix count", n, err)
+	}
+
+	acc := []string{}
+	cur := ""
+	for {
+		res, next, err := piv.Query(&pfx{}).Prefix("Name", "Jo").Limit(2).After(cur).Page()
+		if err != nil {
+			t.Fatal(err)
+		}
+		acc = append(acc, names(res)...)
+		if next == "" {
+			break
+		}
+		cur = next
+	}
+	if !reflect.DeepEqual(acc, []string{"John", "Joan", "Jo"}) {
+		t.Error("wrong prefix pages", acc)
+	}
+
+	_, err = piv.Query(&pfx{}).Prefix("Note", "x").Run()
+	if !errors.Is(err, ErrInvalidParameter) {
+		t.Error("prefix on non indexed field should fail", err)
+	}
+
+	err = piv.Update(&pfx{Nick: "Johan"}, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, _, err := piv.Distinct(pfx{}, "Nick", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, []Distinct{{"bobby", 1}, {"j\x00o", 1}, {"jo", 1}, {"joey", 1}, {"johan", 1}}) {
+		t.Error("wrong folded values", res)
+	}
+
+	_, _, err = piv.Delete(&pfx{}, ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := piv.Check(pfx{})
+	if err != nil || !rep.Clean() {
+		t.Error("folded index should be consistent", rep, err)
+	}
+
+	type bad struct {
+		ID  string
+		Age int `slap:"fold"`
+	}
+
+	_, err = piv.Create(&bad{Age: 1})
+	if !errors.Is(err, ErrInvalidParameter) {
+		t.Error("fold on non string should fail", err)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type note struct {
+		ID    string
+		Title string `slap:"text"`
+		Body  string `slap:"text=stem"`
+		Tag   string
+	}
+
+	arr := []note{
+		{Title: "Badger database", Body: "Walking through the keys of a badger store"},
+		{Title: "Go notes", Body: "Notes on go routines and channels"},
+		{Title: "Badger tips", Body: "The badger walks quickly. Store keys sorted"},
+		{Title: "Cooking", Body: "Recipes with quick tips"},
+	}
+
+	ids, err := piv.Create(&arr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := func(q string) []string {
+		hits, err := piv.Search(note{}, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		acc := []string{}
+		for _, h := range hits {
+			acc = append(acc, h.Record.(note).ID)
+		}
+		return acc
+	}
+
+	for _, c := range []struct {
+		q   string
+		out []string
+	}{
+		{"badger", []string{ids[2], ids[0]}},
+		{"BADGER walk", []string{ids[2], ids[0]}},
+		{`"keys sorted"`, []string{ids[2]}},
+		{`"badger store"`, []string{ids[0]}},
+		{`"store badger"`, []string{}},
+		{"cooking OR routines", []string{ids[1], ids[3]}},
+		{"tips", []string{ids[3], ids[2]}},
+		{"badger tips OR database", []string{ids[2], ids[0]}},
+		{"badger cooking", []string{}},
+		{"", []string{}},
+		{`" ... "`, []string{}},
+	} {
+		out := found(c.q)
+		sort.Strings(out)
+		exp := append([]string{}, c.out...)
+		sort.Strings(exp)
+		if !reflect.DeepEqual(out, exp) {
+			t.Error("wrong hits", c.q, out, exp)
+		}
+	}
+
+	hits, err := piv.Search(note{}, "badger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 2 || hits[0].Record.(note).ID != ids[2] || hits[0].Score <= hits[1].Score {
+		t.Error("shorter document should rank first", hits)
+	}
+
+	err = piv.Update(&note{Body: "A badger den"}, ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found("badger")) != 3 || len(found("routines")) != 0 || len(found("go")) != 1 {
+		t.Error("update should replace postings")
+	}
+
+	counted := func(f string) (textstat, textstat) {
+		var st, cn *textstat
+		k := piv.key("note")
+		k.field = f
+		err := piv.db.View(func(txn *badger.Txn) error {
+			var err error
+			st, err = piv.stat(txn, k)
+			if err != nil {
+				return err
+			}
+			cn, err = piv.census(txn, k)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *st, *cn
+	}
+
+	for _, f := range []string{"Title", "Body"} {
+		if st, cn := counted(f); st != cn || st.N != 4 {
+			t.Error("text counters should follow documents", f, st, cn)
+		}
+	}
+
+	other := &Store{db: piv.db, schema: "other"}
+	_, err = other.Create(&note{Title: "Badger elsewhere"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hits, err = other.Search(note{}, "badger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || len(found("badger")) != 3 {
+		t.Error("schemas should not share postings", len(hits))
+	}
+	if st, _ := counted("Title"); st.N != 4 {
+		t.Error("schemas should not share text counters", st)
+	}
+
+	_, _, err = piv.Delete(&note{}, ids...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st, _ := counted("Body"); st != (textstat{}) {
+		t.Error("text counters should drop deleted documents", st)
+	}
+
+	piv.db.View(func(txn *badger.Txn) error {
+		for _, pfx := range []string{_textSchema, _docSchema} {
+			if keys := prefixed(txn, []byte(pfx+":sparkle:")); len(keys) != 0 {
+				t.Error("text keyspace should be empty", keys)
+			}
+		}
+		return nil
+	})
+
+	ids, err = piv.Create(&note{Title: "dangling"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = piv.db.Update(func(txn *badger.Txn) error {
+		k := piv.key("note")
+		k.id = ids[0]
+		return txn.Delete([]byte(k.recordK()))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found("dangling")) != 0 {
+		t.Error("postings of missing records should be skipped")
+	}
+
+	_, err = piv.Search(struct{ ID, Name string }{}, "x")
+	if !errors.Is(err, ErrInvalidParameter) {
+		t.Error("table without text fields should fail", err)
+	}
+
+	for w, s := range map[string]string{"walking": "walk", "walked": "walk", "classes": "class", "stories": "story", "bus": "bus", "is": "is", "cats": "cat"} {
+		if stem(w) != s {
+			t.Error("wrong stem", w, stem(w))
+		}
+	}
+}
+
+func TestSearchConcurrent(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type note struct {
+		ID    string
+		Title string `slap:"text"`
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				_, err := piv.Create(&note{Title: "badger notes"})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	hits, err := piv.Search(note{}, "badger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 200 {
+		t.Error("concurrent creates should all be indexed", len(hits))
+	}
+
+	k := piv.key("note")
+	k.field = "Title"
+	err = piv.db.View(func(txn *badger.Txn) error {
+		st, err := piv.stat(txn, k)
+		if err == nil && st.N != 200 {
+			t.Error("text counter should count every create", st)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGeo(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type site struct {
+		ID   string
+		Name string
+		Kind string `slap:"index"`
+		At   Point  `slap:"geo"`
+	}
+
+	arr := []site{
+		{Name: "Berlin", Kind: "city", At: Point{52.52, 13.405}},
+		{Name: "Potsdam", Kind: "town", At: Point{52.39, 13.06}},
+		{Name: "Hamburg", Kind: "city", At: Point{53.55, 9.99}},
+		{Name: "Paris", Kind: "city", At: Point{48.85, 2.35}},
+		{Name: "West", Kind: "isle", At: Point{-17.7, 179.9}},
+		{Name: "East", Kind: "isle", At: Point{-17.8, -179.9}},
+	}
+
+	ids, err := piv.Create(&arr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(q *Query) []string {
+		res, err := q.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		acc := []string{}
+		for _, r := range res {
+			acc = append(acc, r.(site).Name)
+		}
+		sort.Strings(acc)
+		return acc
+	}
+
+	berlin := Point{52.52, 13.405}
+	for _, c := range []struct {
+		q   *Query
+		out []string
+	}{
+		{piv.Query(&site{}).Near("At", berlin, 30000), []string{"Berlin", "Potsdam"}},
+		{piv.Query(&site{}).Near("At", berlin, 5000), []string{"Berlin"}},
+		{piv.Query(&site{}).Near("At", berlin, 300000), []string{"Berlin", "Hamburg", "Potsdam"}},
+		{piv.Query(&site{Kind: "city"}).Near("At", berlin, 300000), []string{"Berlin", "Hamburg"}},
+		{piv.Query(&site{Name: "Potsdam"}).Near("At", berlin, 300000), []string{"Potsdam"}},
+		{piv.Query(&site{}).Near("At", berlin, 300000).Order("-Name"), []string{"Berlin", "Hamburg", "Potsdam"}},
+		{piv.Query(&site{}).Within("At", Box{47, 5, 55, 15}), []string{"Berlin", "Hamburg", "Potsdam"}},
+		{piv.Query(&site{}).Within("At", Box{40, -10, 55, 5}), []string{"Paris"}},
+		{piv.Query(&site{}).Within("At", Box{-20, 177, -15, -179}), []string{"East", "West"}},
+		{piv.Query(&site{}).Within("At", Box{-20, 179.95, -15, 180}), []string{}},
+		{piv.Query(&site{}).Near("At", Point{-17.75, 180}, 20000), []string{"East", "West"}},
+		{piv.Query(&site{}).Near("At", Point{89, 0}, 1000), []string{}},
+		{piv.Query(&site{}).Within("At", Box{-90, -180, 90, 180}), []string{"Berlin", "East", "Hamburg", "Paris", "Potsdam", "West"}},
+	} {
+		if out := names(c.q); !reflect.DeepEqual(out, c.out) {
+			t.Error("wrong geo results", out, c.out)
+		}
+	}
+
+	n, err := piv.Count(piv.Query(&site{}).Near("At", berlin, 30000))
+	if err != nil || n != 2 {
+		t.Error("wrong geo count", n, err)
+	}
+
+	if d := Distance(berlin, Point{48.85, 2.35}); d < 870000 || d > 885000 {
+		t.Error("wrong distance", d)
+	}
+
+	err = piv.Update(&site{At: Point{48.86, 2.34}}, ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out := names(piv.Query(&site{}).Near("At", berlin, 30000)); !reflect.DeepEqual(out, []string{"Berlin"}) {
+		t.Error("update should move geo index", out)
+	}
+
+	_, _, err = piv.Delete(&site{}, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := piv.Check(site{})
+	if err != nil || !rep.Clean() {
+		t.Error("geo index should be consistent", rep, err)
+	}
+
+	_, err = piv.Create(&site{Name: "Nowhere", Kind: "isle"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []*Query{
+		piv.Query(&site{}).Within("At", Box{-1, -1, 1, 1}),
+		piv.Query(&site{Kind: "isle"}).Near("At", Point{}, 1000),
+	} {
+		if out := names(q); len(out) != 0 {
+			t.Error("missing point should not match", out)
+		}
+	}
+
+	_, err = piv.Query(&site{}).Within("At", Box{}).Within("Kind", Box{}).Run()
+	if !errors.Is(err, ErrInvalidParameter) {
+		t.Error("area on non geo field should fail", err)
+	}
+
+	type bad struct {
+		ID string
+		At string `slap:"geo"`
+	}
+
+	_, err = piv.Create(&bad{At: "x"})
+	if !errors.Is(err, ErrInvalidParameter) {
+		t.Error("geo on non point should fail", err)
+	}
+}
+
+func TestNearest(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type emb struct {
+		ID   string
+		Kind string    `slap:"index"`
+		Vec  []float32 `slap:"vector"`
+	}
+
+	rng := rand.New(rand.NewSource(7))
+	arr := []emb{}
+	for i := 0; i < 200; i++ {
+		v := make([]float32, 16)
+		for j := range v {
+			v[j] = float32(rng.NormFloat64())
+		}
+		arr = append(arr, emb{Kind: []string{"a", "b"}[i%2], Vec: v})
+	}
+
+	ids, err := piv.Create(&arr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range []Metric{Cosine, Dot, L2} {
+		hits, err := piv.Nearest(piv.Query(&emb{}), "Vec", arr[7].Vec, 5, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) != 5 {
+			t.Fatal("wrong hit count", m, len(hits))
+		}
+		if m != Dot && hits[0].Record.(emb).ID != ids[7] {
+			t.Error("record should be nearest to itself", m)
+		}
+		for i := 1; i < len(hits); i++ {
+			if (m == L2) != (hits[i-1].Score <= hits[i].Score) {
+				t.Error("hits should be ranked", m, hits[i-1].Score, hits[i].Score)
+			}
+		}
+	}
+
+	hits, err := piv.Nearest(piv.Query(&emb{Kind: "b"}), "Vec", arr[7].Vec, 10, L2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dist := make(map[string]float64)
+	exp := []string{}
+	for i := 1; i < len(arr); i += 2 {
+		dist[ids[i]] = measure(L2, arr[7].Vec, arr[i].Vec)
+		exp = append(exp, ids[i])
+	}
+	sort.Slice(exp, func(i, j int) bool {
+		return dist[exp[i]] < dist[exp[j]]
+	})
+
+	out := []string{}
+	for _, h := range hits {
+		if h.Record.(emb).Kind != "b" {
+			t.Error("pre filter should hold")
+		}
+		out = append(out, h.Record.(emb).ID)
+	}
+	if !reflect.DeepEqual(out, exp[:10]) {
+		t.Error("filtered search should be exact", out, exp[:10])
+	}
+
+	hits, err = piv.Nearest(piv.Query(&emb{}), "Vec", arr[0].Vec, 500, Cosine)
+	if err != nil || len(hits) != 200 {
+		t.Error("large k should return all records", len(hits), err)
+	}
+
+	v := make([]float32, 16)
+	v[3] = 1
+	err = piv.Update(&emb{Vec: v}, ids[11])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hits, err = piv.Nearest(piv.Query(&emb{}), "Vec", v, 1, Cosine)
+	if err != nil || len(hits) != 1 || hits[0].Record.(emb).ID != ids[11] {
+		t.Error("update should move vector buckets", hits, err)
+	}
+
+	type pair struct {
+		ID  string
+		Vec []float32 `slap:"vector"`
+	}
+
+	w := make([]float32, 16)
+	w[3] = -1
+	pids, err := piv.Create(&[]pair{{Vec: v}, {Vec: w}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &Store{db: piv.db, schema: "other"}
+	_, err = other.Create(&[]pair{{Vec: v}, {Vec: v}, {Vec: v}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hits, err = piv.Nearest(piv.Query(&pair{}), "Vec", v, 2, Cosine)
+	if err != nil || len(hits) != 2 {
+		t.Error("buckets of other schemas should not be candidates", len(hits), err)
+	}
+
+	_, _, err = piv.Delete(&pair{}, pids...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = piv.Nearest(piv.Query(&emb{}), "Kind", v, 1, Cosine)
+	if !errors.Is(err, ErrInvalidParameter) {
+		t.Error("non vector field should fail", err)
+	}
+
+	_, _, err = piv.Delete(&emb{}, ids...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	piv.db.View(func(txn *badger.Txn) error {
+		for _, pfx := range []string{_vectorSchema, _vecdocSchema} {
+			if keys := prefixed(txn, []byte(pfx+":sparkle:")); len(keys) != 0 {
+				t.Error("vector keyspace should be empty", len(keys))
+			}
+		}
+		return nil
+	})
+
+	type bad struct {
+		ID  string
+		Vec []float64 `slap:"vector"`
+	}
+
+	_, err = piv.Create(&bad{Vec: []float64{1}})
+	if !errors.Is(err, ErrInvalidParameter) {
+		t.Error("vector on non float32 slice should fail", err)
+	}
+
+	if &hyperplanes(5)[0][0] != &hyperplanes(5)[0][0] || !reflect.DeepEqual(hashes([]float32{1, 2, 3}), hashes([]float32{1, 2, 3})) {
+		t.Error("hyperplanes should be drawn once per dimension")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type wch struct {
+		ID    string
+		Group string `slap:"index"`
+		Name  string
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	all := make(chan []Event, 10)
+	some := make(chan []Event, 10)
+	done := make(chan error, 2)
+
+	go func() {
+		done <- piv.Watch(ctx, piv.Query(&wch{}), func(evs []Event) error {
+			all <- evs
+			return nil
+		})
+	}()
+	go func() {
+		done <- piv.Watch(ctx, piv.Query(&wch{Group: "b"}), func(evs []Event) error {
+			some <- evs
+			return nil
+		})
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	arr := []wch{{Group: "a", Name: "x"}, {Group: "b", Name: "y"}}
+	ids, err := piv.Create(&arr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = piv.Atomic().Update(&wch{Name: "z"}, ids...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = piv.Delete(&wch{}, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = piv.Create(&struct{ ID, Name string }{Name: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := func(ch chan []Event) []Event {
+		select {
+		case evs := <-ch:
+			return evs
+		case <-time.After(2 * time.Second):
+			t.Fatal("no events")
+		}
+		return nil
+	}
+
+	for i := range arr {
+		evs := next(all)
+		if len(evs) != 1 || evs[0].Op != Created || evs[0].ID != ids[i] {
+			t.Fatal("wrong create event", evs)
+		}
+		if evs[0].Record.(wch) != (wch{ID: ids[i], Group: arr[i].Group, Name: arr[i].Name}) || !reflect.DeepEqual(evs[0].Fields, []string{"Group", "Name"}) {
+			t.Error("wrong created record", evs[0])
+		}
+	}
+
+	evs := next(all)
+	if len(evs) != 2 || evs[0].Op != Updated || evs[0].ID != ids[0] || evs[1].ID != ids[1] || evs[0].Version != evs[1].Version {
+		t.Fatal("updates should arrive as one transaction", evs)
+	}
+	if evs[1].Record.(wch) != (wch{ID: ids[1], Name: "z"}) || !reflect.DeepEqual(evs[1].Fields, []string{"Name"}) {
+		t.Error("wrong update event", evs[1])
+	}
+
+	evs = next(all)
+	if len(evs) != 1 || evs[0].Op != Deleted || evs[0].ID != ids[0] || len(evs[0].Fields) != 0 {
+		t.Error("wrong delete event", evs)
+	}
+
+	evs = next(some)
+	if len(evs) != 1 || evs[0].ID != ids[1] || evs[0].Op != Created {
+		t.Error("filtered watch should see matching create", evs)
+	}
+	evs = next(some)
+	if len(evs) != 1 || evs[0].ID != ids[1] || evs[0].Op != Updated {
+		t.Error("filtered watch should see matching update only", evs)
+	}
+	evs = next(some)
+	if len(evs) != 1 || evs[0].Op != Deleted {
+		t.Error("filtered watch should see deletes", evs)
+	}
+
+	err = piv.WithDB(func(db *badger.DB) error {
+		return db.Update(func(txn *badger.Txn) error {
+			k := piv.key("wch")
+			k.id = ids[1]
+			return txn.Set([]byte(k.recordK()), []byte{0})
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = piv.Update(&wch{Name: "w"}, ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		evs = next(all)
+		if len(evs) != 1 || evs[0].Op != Updated {
+			t.Error("update of unversioned record should not be a create", evs)
+		}
+	}
+
+	select {
+	case evs := <-all:
+		t.Error("other tables should not be watched", evs)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Error("watch should stop cleanly", err)
+		}
+	}
+}
+
+func TestTTL(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type sess struct {
+		ID    string
+		User  string    `slap:"index"`
+		Note  string    `slap:"text"`
+		Until time.Time `slap:"ttl"`
+	}
+
+	expires := func(key string) uint64 {
+		var exp uint64
+		err := piv.db.View(func(txn *badger.Txn) error {
+			i, err := txn.Get([]byte(key))
+			if err != nil {
+				return err
+			}
+			exp = i.ExpiresAt()
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exp
+	}
+	enc := func(x string) []byte {
+		bts, _ := toKey(x)
+		return bts
+	}
+
+	short := piv.TTL(time.Second)
+	ids, err := short.Create(&[]sess{{User: "ann", Note: "gone soon"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	later := time.Now().Add(time.Hour).Truncate(time.Second)
+	kept, err := short.Create(&sess{User: "bob", Note: "stays", Until: later})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := piv.key("sess")
+	k.id = kept[0]
+	k.field = "User"
+	if expires(k.recordK()) != uint64(later.Unix()) {
+		t.Error("ttl field should override store TTL")
+	}
+	if expires(k.indexK(enc("bob"))) != uint64(later.Unix()) {
+		t.Error("index should expire with record")
+	}
+
+	err = piv.Update(&sess{User: "cid"}, kept[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.field = "User"
+	if expires(k.indexK(enc("cid"))) != uint64(later.Unix()) {
+		t.Error("update should keep record expiry")
+	}
+
+	further := later.Add(time.Hour)
+	err = piv.Update(&sess{Until: further}, kept[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.field = "Note"
+	if expires(k.fieldK()) != uint64(further.Unix()) || expires(k.textK("stays")) != uint64(further.Unix()) {
+		t.Error("new ttl should apply to every key of record")
+	}
+
+	time.Sleep(2 * time.Second)
+
+	_, err = piv.Read(&sess{}, nil, ids[0])
+	if !errors.Is(err, ErrNoRecord) {
+		t.Error("expired record should not be read", err)
+	}
+
+	res, err := piv.Select(&sess{User: "ann"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Error("expired record should not be selected")
+	}
+
+	hits, err := piv.Search(&sess{}, "soon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 0 {
+		t.Error("expired record should not be found")
+	}
+
+	res, err = piv.Read(&sess{}, nil, kept[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0].(sess).User != "cid" {
+		t.Error("unexpired record should remain")
+	}
+
+	rep, err := piv.Check(&sess{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.Clean() {
+		t.Error("expiry should leave no faults", rep.Faults)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type acct struct {
+		ID      string
+		Owner   string `slap:"index"`
+		Balance int
+		Rev     uint64 `slap:"version"`
+	}
+
+	ids, err := piv.Create(&acct{Owner: "ann", Balance: 10, Rev: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := ids[0]
+
+	res, err := piv.Read(&acct{}, nil, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0].(acct).Rev != 1 {
+		t.Error("new record should be version 1", res[0].(acct).Rev)
+	}
+
+	err = piv.Update(&acct{Balance: 20}, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = piv.Select(&acct{Owner: "ann"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0].(acct).Rev != 2 {
+		t.Error("update should bump version", res[0].(acct).Rev)
+	}
+
+	err = piv.UpdateIf(&acct{Balance: 30}, 1, id)
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Error("stale update should conflict", err)
+	}
+
+	err = piv.UpdateIf(&acct{Balance: 30}, 2, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = piv.UpdateIf(&acct{Balance: 30}, 1, "none")
+	if !errors.Is(err, ErrNoRecord) {
+		t.Error("missing record should be reported", err)
+	}
+
+	won := make(chan error, 2)
+	for _, b := range []int{40, 50} {
+		go func(b int) {
+			won <- piv.UpdateIf(&acct{Balance: b}, 3, id)
+		}(b)
+	}
+	a, b := <-won, <-won
+	if (a == nil) == (b == nil) {
+		t.Error("exactly one concurrent update should win", a, b)
+	}
+
+	err = piv.DeleteIf(&acct{}, 3, id)
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Error("stale delete should conflict", err)
+	}
+
+	res, err = piv.Read(&acct{}, nil, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := res[0].(acct); r.Rev != 4 || (r.Balance != 40 && r.Balance != 50) {
+		t.Error("winning update should be stored", r)
+	}
+
+	err = piv.DeleteIf(&acct{}, 4, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = piv.Read(&acct{}, nil, id)
+	if !errors.Is(err, ErrNoRecord) {
+		t.Error("record should be deleted", err)
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type page struct {
+		ID    string
+		Views int `slap:"index"`
+		Score float64
+		Title string `slap:"text"`
+	}
+
+	ids, err := piv.Create(&page{Title: "draft notes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := ids[0]
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := piv.Increment(&page{}, id, "Views", 1)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	res, err := piv.Select(&page{Views: 20}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].(page).ID != id {
+		t.Error("increments should all apply and be indexed", res)
+	}
+
+	x, err := piv.Increment(&page{}, id, "Score", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x != 1.0 {
+		t.Error("delta should convert to field type", x)
+	}
+
+	_, err = piv.Increment(&page{}, id, "Title", 1)
+	if !errors.Is(err, ErrInvalidParameter) {
+		t.Error("non numeric field should be rejected", err)
+	}
+
+	_, err = piv.Increment(&page{}, "none", "Views", 1)
+	if !errors.Is(err, ErrNoRecord) {
+		t.Error("missing record should be reported", err)
+	}
+
+	_, err = piv.Increment(&page{}, id, "Views", 0.5)
+	if !errors.Is(err, ErrTypeConversion) {
+		t.Error("fractional delta on integer field should be rejected", err)
+	}
+
+	ok, err := piv.CompareAndSwap(&page{}, id, "Title", "final", "published notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("swap should fail on stale value")
+	}
+
+	ok, err = piv.CompareAndSwap(&page{}, id, "Title", "draft notes", "published notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("swap should succeed on current value")
+	}
+
+	hits, err := piv.Search(&page{}, "published")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 {
+		t.Error("swap should update text index")
+	}
+
+	_, err = piv.CompareAndSwap(&page{}, id, "Views", 20, int64(0))
+	if !errors.Is(err, ErrTypeConversion) {
+		t.Error("mistyped value should be rejected", err)
+	}
+
+	ok, err = piv.CompareAndSwap(&page{}, id, "Views", 20, 0)
+	if err != nil || !ok {
+		t.Fatal("swap to zero should succeed", err)
+	}
+
+	rep, err := piv.Check(&page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.Clean() {
+		t.Error("swaps should keep index consistent", rep.Faults)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type doc struct {
+		ID    string `slap:"history"`
+		Title string `slap:"index"`
+		Body  string
+		Rev   uint64 `slap:"version"`
+	}
+
+	ids, err := piv.Create(&doc{Title: "draft", Body: "one"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := ids[0]
+	first := time.Now()
+
+	err = piv.Update(&doc{Body: "two"}, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := time.Now()
+
+	err = piv.Update(&doc{Title: "final"}, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = piv.Delete(&doc{}, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x, err := piv.ReadAt(&doc{}, id, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := x.(doc); d.ID != id || d.Title != "draft" || d.Body != "one" || d.Rev != 1 {
+		t.Error("wrong state after create", d)
+	}
+
+	other := &Store{db: piv.db, schema: "other"}
+	cs, err := other.History(&doc{}, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.ReadAt(&doc{}, id, first)
+	if len(cs) != 0 || !errors.Is(err, ErrNoRecord) {
+		t.Error("history should be scoped to the schema", cs, err)
+	}
+
+	x, err = piv.ReadAt(&doc{}, id, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := x.(doc); d.Title != "draft" || d.Body != "two" || d.Rev != 2 {
+		t.Error("wrong state after update", d)
+	}
+
+	_, err = piv.ReadAt(&doc{}, id, time.Now())
+	if !errors.Is(err, ErrNoRecord) {
+		t.Error("deleted record should not be read", err)
+	}
+
+	_, err = piv.ReadAt(&doc{}, id, first.Add(-time.Hour))
+	if !errors.Is(err, ErrNoRecord) {
+		t.Error("record should not exist before creation", err)
+	}
+
+	cs, err = piv.History(&doc{}, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := []Op{Created, Updated, Updated, Deleted}
+	fields := [][]string{{"Body", "Title"}, {"Body"}, {"Title"}, {}}
+	if len(cs) != len(ops) {
+		t.Fatal("wrong change count", len(cs))
+	}
+	for i, c := range cs {
+		if c.Op != ops[i] || !reflect.DeepEqual(c.Fields, fields[i]) {
+			t.Error("wrong change", i, c.Op, c.Fields)
+		}
+		if i > 0 && !c.Time.After(cs[i-1].Time) {
+			t.Error("changes should be ordered by time")
+		}
+	}
+	if cs[2].Record.(doc).Title != "final" {
+		t.Error("change should hold record state", cs[2].Record)
+	}
+
+	type plain struct {
+		ID   string
+		Name string
+	}
+	_, err = piv.History(&plain{}, id)
+	if !errors.Is(err, ErrInvalidParameter) {
+		t.Error("history should be opt in", err)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type owner struct {
+		ID   string `slap:"audit"`
+		Name string
+	}
+	type pet struct {
+		ID    string `slap:"audit"`
+		Name  string
+		Owner string `slap:"ref=owner,cascade"`
+		Age   int
+	}
+	type memo struct {
+		ID   string
+		Name string
+	}
+
+	aud := piv.Context(WithActor(context.Background(), "ann"))
+
+	oids, err := aud.Create(&owner{Name: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pids, err := aud.Create(&pet{Name: "rex", Owner: oids[0], Age: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = aud.Context(WithActor(context.Background(), "cid")).Update(&pet{Age: 4}, pids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = piv.Create(&memo{Name: "untracked"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = aud.Delete(&owner{}, oids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	es, err := aud.AuditLog(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := []Op{Created, Created, Updated, Deleted, Deleted}
+	if len(es) != len(ops) {
+		t.Fatal("wrong entry count", len(es))
+	}
+	for i, e := range es {
+		if e.Op != ops[i] || e.Seq != uint64(i+1) {
+			t.Error("wrong entry", i, e.Op, e.Seq)
+		}
+	}
+
+	up := es[2]
+	if up.Actor != "cid" || !reflect.DeepEqual(up.Fields, []string{"Age"}) || up.Old["Age"] != 3 || up.New["Age"] != 4 {
+		t.Error("update should log changed values", up)
+	}
+
+	cas := es[3]
+	if cas.Table != "pet" || cas.Old["Name"] != "rex" || len(cas.New) != 0 {
+		t.Error("cascade should log deleted values", cas)
+	}
+
+	es, err = aud.AuditLog(AuditFilter{Table: &pet{}, Actor: "ann"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 2 {
+		t.Error("filter should match pet entries by ann", len(es))
+	}
+
+	var buf bytes.Buffer
+	err = aud.ExportAudit(&buf, AuditFilter{ID: pids[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 3 {
+		t.Error("export should write a line per entry", n)
+	}
+
+	err = aud.VerifyAudit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tail := append([]byte(_auditSchema+":"), 0, 0, 0, 0, 0, 0, 0, 5)
+	var cut []byte
+	err = piv.db.Update(func(txn *badger.Txn) error {
+		i, err := txn.Get(tail)
+		if err != nil {
+			return err
+		}
+		cut, err = i.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		return txn.Delete(tail)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = aud.VerifyAudit()
+	if !errors.Is(err, ErrTampered) {
+		t.Error("truncation should be detected", err)
+	}
+
+	err = piv.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(tail, cut)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = piv.db.Update(func(txn *badger.Txn) error {
+		key := append([]byte(_auditSchema+":"), 0, 0, 0, 0, 0, 0, 0, 3)
+		i, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		var tr trail
+		err = i.Value(func(v []byte) error {
+			return gob.NewDecoder(bytes.NewReader(v)).Decode(&tr)
+		})
+		if err != nil {
+			return err
+		}
+		tr.New["Age"], _ = toBytes(40)
+		bts, _ := toBytes(tr)
+		return txn.Set(key, bts)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = aud.VerifyAudit()
+	if !errors.Is(err, ErrTampered) {
+		t.Error("tampering should be detected", err)
+	}
+}
+
+func TestAuditSchema(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type aud struct {
+		ID   string `slap:"audit"`
+		Name string
+	}
+
+	other := &Store{db: piv.db, schema: "other"}
+	for _, st := range []*Store{piv, other} {
+		_, err := st.Create(&aud{Name: st.schema})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, st := range []*Store{piv, other} {
+		es, err := st.AuditLog(AuditFilter{Table: &aud{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(es) != 1 || es[0].Schema != st.schema || es[0].New["Name"] != st.schema {
+			t.Error("audit log should be scoped to the schema", st.schema, es)
+		}
+	}
+
+	err := other.VerifyAudit()
+	if err != nil {
+		t.Error("chain should span schemas", err)
+	}
+}
+
+func TestAuditConcurrent(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type owner struct {
+		ID   string `slap:"audit"`
+		Name string
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			aud := piv.Context(WithActor(context.Background(), fmt.Sprint(i)))
+			_, err := aud.Create(&owner{Name: "bob"})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	es, err := piv.AuditLog(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 20 {
+		t.Error("every write should be logged", len(es))
+	}
+
+	err = piv.VerifyAudit()
+	if err != nil {
+		t.Error("concurrent writes should keep the chain linear", err)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type note struct {
+		ID   string `slap:"soft"`
+		Tag  string `slap:"index"`
+		Body string `slap:"text"`
+	}
+
+	ids, err := piv.Create(&[]note{{Tag: "a", Body: "alpha"}, {Tag: "a", Body: "beta"}, {Tag: "b", Body: "gamma"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, missing, err := piv.Delete(&note{}, ids[0], ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || len(missing) != 1 {
+		t.Error("record should be deleted once", removed, missing)
+	}
+
+	_, err = piv.Read(&note{}, nil, ids[0])
+	if !errors.Is(err, ErrNoRecord) {
+		t.Error("deleted record should not be read", err)
+	}
+
+	err = piv.Update(&note{Body: "again"}, ids[0])
+	if !errors.Is(err, ErrNoRecord) {
+		t.Error("deleted record should not be updated", err)
+	}
+
+	res, err := piv.Select(&note{Tag: "a"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].(note).ID != ids[1] {
+		t.Error("deleted record should not be selected", res)
+	}
+
+	res, _, err = piv.Take(&note{}, nil, Span{}, 0, "Tag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 {
+		t.Error("deleted record should not be taken", len(res))
+	}
+
+	res, next, err := piv.Query(&note{}).Order("-Body").Limit(2).Page()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || next != "" {
+		t.Error("deleted record should not continue a sorted page", len(res), next)
+	}
+
+	res, next, err = piv.Query(&note{}).Prefix("Tag", "a").Limit(1).Page()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].(note).ID != ids[1] || next != "" {
+		t.Error("deleted record should not continue a prefix page", res, next)
+	}
+
+	n, err := piv.Count(piv.Query(&note{}).IncludeDeleted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Error("deleted record should be counted when included", n)
+	}
+
+	res, err = piv.Query(&note{Tag: "a"}).IncludeDeleted().Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 {
+		t.Error("deleted record should be selected when included", len(res))
+	}
+
+	hits, err := piv.Search(&note{}, "alpha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 0 {
+		t.Error("deleted record should not be found")
+	}
+
+	ds, _, err := piv.Distinct(&note{}, "Tag", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 2 || ds[0].Count != 1 {
+		t.Error("deleted record should not be distinct", ds)
+	}
+
+	err = piv.Restore(&note{}, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = piv.Restore(&note{}, ids[0])
+	if !errors.Is(err, ErrNoRecord) {
+		t.Error("live record should not be restored", err)
+	}
+
+	res, err = piv.Read(&note{}, nil, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0].(note).Body != "alpha" {
+		t.Error("restored record should keep fields", res[0])
+	}
+
+	_, _, err = piv.Delete(&note{}, ids[0], ids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	purged, _, err := piv.Purge(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 0 {
+		t.Error("recent deletes should be kept", purged)
+	}
+
+	other := &Store{db: piv.db, schema: "other"}
+	purged, _, err = other.Purge(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 0 {
+		t.Error("purge should keep deletes of other schemas", purged)
+	}
+
+	purged, _, err = piv.Purge(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 2 {
+		t.Error("deletes should be purged", purged)
+	}
+
+	err = piv.Restore(&note{}, ids[0])
+	if !errors.Is(err, ErrNoRecord) {
+		t.Error("purged record should not be restored", err)
+	}
+
+	n, err = piv.Count(piv.Query(&note{}).IncludeDeleted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Error("purged records should be gone", n)
+	}
+
+	rep, err := piv.Check(&note{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.Clean() {
+		t.Error("purge should remove index entries", rep.Faults)
+	}
+
+	err = piv.db.View(func(txn *badger.Txn) error {
+		if len(prefixed(txn, []byte(_deletedSchema+":"))) != 0 || len(prefixed(txn, []byte(_textSchema+":"))) != 1 {
+			t.Error("purge should remove tombstones and postings")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSoftPurge(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type shelf struct {
+		ID   string `slap:"soft"`
+		Name string
+	}
+	type book struct {
+		ID    string
+		Shelf string `slap:"ref=shelf,restrict"`
+	}
+
+	sids, err := piv.Create(&[]shelf{{Name: "a"}, {Name: "b"}, {Name: "c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = piv.Create(&book{Shelf: sids[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, st := range []*Store{piv, piv.Atomic()} {
+		_, _, err = piv.Delete(&shelf{}, sids[0], sids[i+1])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		purged, kept, err := st.Purge(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(kept) != 1 || kept[0] != (Grave{"shelf", sids[0]}) {
+			t.Error("restricted record should be kept and reported", kept)
+		}
+		if purged != 1 {
+			t.Error("unreferenced record should be purged", purged)
+		}
+
+		err = piv.Restore(&shelf{}, sids[i+1])
+		if !errors.Is(err, ErrNoRecord) {
+			t.Error("purged record should not be restored", err)
+		}
+		err = piv.Restore(&shelf{}, sids[0])
+		if err != nil {
+			t.Error("kept record should be restorable", err)
+		}
+	}
+
+	_, _, err = piv.Delete(&shelf{}, sids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = piv.Create(&book{Shelf: sids[0]})
+	if !errors.Is(err, ErrNoReference) {
+		t.Error("soft deleted record should not be referenced", err)
+	}
+}
+
+func TestSoftWatch(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type note struct {
+		ID   string `slap:"soft,audit"`
+		Body string
+	}
+
+	ids, err := piv.Create(&note{Body: "alpha"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan []Event, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- piv.Watch(ctx, piv.Query(&note{}), func(evs []Event) error {
+			ch <- evs
+			return nil
+		})
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	_, _, err = piv.Delete(&note{}, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = piv.Restore(&note{}, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range []Op{Deleted, Restored} {
+		select {
+		case evs := <-ch:
+			if len(evs) != 1 || evs[0].Op != op || evs[0].ID != ids[0] {
+				t.Error("wrong soft delete event", op, evs)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no events", op)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+
+	es, err := piv.AuditLog(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 3 || es[1].Op != Deleted || es[2].Op != Restored || es[2].New["Body"] != "alpha" {
+		t.Error("restore should be logged as its own op", es)
+	}
+}
+
+type hooked struct {
+	ID    string
+	Name  string `slap:"index"`
+	Slug  string `slap:"index"`
+	Reads int
+	Lock  bool
+}
+
+var hookedLog []string
+
+func (h *hooked) BeforeCreate(txn *badger.Txn) error {
+	if h.Name == "" {
+		return ErrInvalidParameter
+	}
+	h.Slug = strings.ToLower(h.Name)
+	return nil
+}
+
+func (h *hooked) AfterCreate(txn *badger.Txn) error {
+	hookedLog = append(hookedLog, "created "+h.ID)
+	return nil
+}
+
+func (h *hooked) BeforeUpdate(txn *badger.Txn) error {
+	if h.Name != "" {
+		h.Slug = strings.ToLower(h.Name)
+	}
+	return nil
+}
+
+func (h *hooked) AfterRead(txn *badger.Txn) error {
+	h.Reads++
+	return nil
+}
+
+func (h *hooked) BeforeDelete(txn *badger.Txn) error {
+	if h.Lock {
+		return ErrReferenced
+	}
+	return nil
+}
+
+func TestHooks(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+	hookedLog = nil
+
+	_, err := piv.Create(&hooked{})
+	if !errors.Is(err, ErrInvalidParameter) {
+		t.Error("BeforeCreate error should abort", err)
+	}
+
+	n, err := piv.Count(piv.Query(&hooked{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Error("aborted create should write nothing", n)
+	}
+
+	arr := []hooked{{Name: "Ann"}, {Name: "Bob", Lock: true}}
+	ids, err := piv.Create(&arr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arr[0].Slug != "ann" || len(hookedLog) != 2 || hookedLog[0] != "created "+ids[0] {
+		t.Error("create hooks should run in order", arr, hookedLog)
+	}
+
+	res, err := piv.Select(&hooked{Slug: "bob"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].(hooked).Reads != 1 {
+		t.Error("derived field should be indexed and AfterRead called", res)
+	}
+
+	err = piv.Update(&hooked{Name: "Anna"}, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = piv.Read(&hooked{}, nil, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0].(hooked).Slug != "anna" {
+		t.Error("BeforeUpdate should derive fields", res[0])
+	}
+
+	ok, err := piv.CompareAndSwap(&hooked{}, ids[0], "Name", "Anna", "Hanna")
+	if err != nil || !ok {
+		t.Fatal("swap should succeed", err)
+	}
+
+	res, err = piv.Select(&hooked{Slug: "hanna"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].(hooked).ID != ids[0] {
+		t.Error("swap should run BeforeUpdate", res)
+	}
+
+	_, err = piv.Increment(&hooked{}, ids[0], "Reads", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = piv.Read(&hooked{}, nil, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := res[0].(hooked); h.Slug != "hanna" || h.Name != "Hanna" {
+		t.Error("increment should keep fields its hook leaves zero", h)
+	}
+
+	_, _, err = piv.Delete(&hooked{}, ids[1])
+	if !errors.Is(err, ErrReferenced) {
+		t.Error("BeforeDelete error should abort", err)
+	}
+
+	ok, err = piv.Exists(&hooked{}, ids[1])
+	if err != nil || !ok {
+		t.Error("aborted delete should keep record", err)
+	}
+
+	removed, _, err := piv.Delete(&hooked{}, ids[0])
+	if err != nil || len(removed) != 1 {
+		t.Error("delete should pass BeforeDelete", err)
+	}
+
+	sl := slugged{Name: "Long"}
+	_, err = piv.Create(&sl)
+	if !errors.Is(err, ErrValidation) {
+		t.Error("derived field should be validated", err)
+	}
+	if sl != (slugged{Name: "Long"}) {
+		t.Error("aborted create should leave struct alone", sl)
+	}
+
+	sl = slugged{Name: "Al"}
+	ids, err = piv.Create(&sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sl.ID != ids[0] || sl.Slug != "al" {
+		t.Error("committed create should set ID and hook changes", sl)
+	}
+}
+
+type slugged struct {
+	ID   string
+	Name string
+	Slug string `slap:"max=3"`
+}
+
+func (h *slugged) BeforeCreate(txn *badger.Txn) error {
+	h.Slug = strings.ToLower(h.Name)
+	return nil
+}
+
+func TestStamps(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	type post struct {
+		ID      string
+		Title   string
+		Views   int
+		Created time.Time `slap:"created"`
+		Updated time.Time `slap:"updated,index"`
+	}
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := piv.Clock(func() time.Time {
+		return now
+	})
+
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ids, err := clk.Create(&[]post{{Title: "a"}, {Title: "b", Created: old}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := clk.Read(&post{}, nil, ids...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := res[0].(post), res[1].(post)
+	if !a.Created.Equal(now) || !a.Updated.Equal(now) {
+		t.Error("create should set stamps", a)
+	}
+	if !b.Created.Equal(old) {
+		t.Error("given created time should be kept", b)
+	}
+
+	now = now.Add(time.Hour)
+	err = clk.Update(&post{Title: "c", Created: now}, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = clk.Increment(&post{}, ids[1], "Views", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = clk.Select(&post{Updated: now}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 {
+		t.Fatal("updates should set updated stamp", len(res))
+	}
+	for _, x := range res {
+		if x.(post).Created.Equal(now) {
+			t.Error("update should keep created stamp", x)
+		}
+	}
+
+	res, err = clk.Select(&post{Updated: now.Add(-time.Hour)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Error("update should move updated index entry", len(res))
+	}
+
+	res, err = clk.Select(&post{Title: "c"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].(post).ID != ids[0] {
+		t.Error("stamped table should be selectable", res)
+	}
+
+	n, err := clk.Count(clk.Query(&post{Title: "b"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Error("stamped table should be counted", n)
+	}
+
+	type bad struct {
+		ID   string
+		When string `slap:"created"`
+	}
+	_, err = piv.Create(&bad{})
+	if !errors.Is(err, ErrInvalidParameter) {
+		t.Error("stamp should require time field", err)
+	}
+}
+
+type checked struct {
+	ID    string
+	Name  string    `slap:"required,min=2,max=8"`
+	Code  string    `slap:"regexp=^[a-z]{2,3}$,index"`
+	Kind  string    `slap:"oneof=a b"`
+	Tags  []float32 `slap:"len=2"`
+	Stock int       `slap:"min=0,max=10"`
+	Lo    int
+	Hi    int
+}
+
+var errWindow = errors.New("window")
+
+func (c checked) Validate() error {
+	if c.Lo > c.Hi {
+		return errWindow
+	}
+	return nil
+}
+
+func TestValidate(t *testing.T) {
+	piv := New("/tmp/badger", "sparkle")
+	defer piv.db.Close()
+	piv.db.DropAll()
+
+	ids, err := piv.Create(&checked{Name: "bob", Code: "ab", Kind: "a", Tags: []float32{1, 2}, Stock: 3, Hi: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := piv.Select(&checked{Code: "ab"}, nil)
+	if err != nil || len(res) != 1 {
+		t.Fatal("regexp with comma should keep index option", res, err)
+	}
+
+	_, err = piv.Create(&checked{Name: "b", Code: "abcd", Kind: "c", Tags: []float32{1}, Stock: 11, Lo: 1})
+	if !errors.Is(err, ErrValidation) {
+		t.Fatal("invalid record should fail", err)
+	}
+
+	var ve *ValidationError
+	if !errors.As(err, &ve) {
+		t.Fatal("error should be a ValidationError", err)
+	}
+	want := []FieldError{
+		{Field: "Code", Rule: "regexp=^[a-z]{2,3}$"},
+		{Field: "Kind", Rule: "oneof=a b"},
+		{Field: "Name", Rule: "min=2"},
+		{Field: "Stock", Rule: "max=10"},
+		{Field: "Tags", Rule: "len=2"},
+	}
+	if !reflect.DeepEqual(ve.Fields, want) {
+		t.Error("every failing field should be listed", ve.Fields)
+	}
+	if !errors.Is(err, errWindow) {
+		t.Error("Validate error should be wrapped", err)
+	}
+
+	_, err = piv.Create(&checked{Code: "ab"})
+	if !errors.As(err, &ve) || len(ve.Fields) != 1 || ve.Fields[0].Rule != "required" {
+		t.Error("missing required field should fail", err)
+	}
+
+	err = piv.Update(&checked{Name: "toolongname"}, ids[0])
+	if !errors.Is(err, ErrValidation) {
+		t.Error("update should check given fields", err)
+	}
+
+	err = piv.Update(&checked{Lo: 9}, ids[0])
+	if !errors.Is(err, errWindow) {
+		t.Error("update should validate the stored record", err)
+	}
+
+	_, err = piv.Increment(&checked{}, ids[0], "Stock", -4)
+	if !errors.Is(err, ErrValidation) {
+		t.Error("increment should check bounds", err)
+	}
+
+	ok, err := piv.CompareAndSwap(&checked{}, ids[0], "Kind", "a", "")
+	if ok || !errors.As(err, &ve) || len(ve.Fields) != 1 || ve.Fields[0].Rule != "oneof=a b" {
+		t.Error("zero value set by swap should be checked", err)
+	}
+
+	res, err = piv.Read(&checked{}, nil, ids...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := res[0].(checked); c.Name != "bob" || c.Lo != 0 || c.Stock != 3 {
+		t.Error("failed updates should not be written", c)
+	}
+
+	type bad struct {
+		ID  string
+		Age int `slap:"len=2"`
+	}
+	_, err = piv.Create(&bad{})
+	if !errors.Is(err, ErrInvalidParameter) {
+		t.Error("length rule should require string or slice", err)
+	}
 }
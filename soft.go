@@ -0,0 +1,275 @@
+package slap
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// tombstone marks a soft deleted record
+// Index, Types and Audit let Purge erase the record without its struct
+type tombstone struct {
+	At    int64
+	Index map[string]string
+	Types map[string]string
+	Audit bool
+}
+
+// IncludeDeleted makes soft deleted records match as well
+func (q *Query) IncludeDeleted() *Query {
+	q.deleted = true
+	return q
+}
+
+// Restore brings back a soft deleted record with given ID
+// Table must have soft delete enabled, tag its ID field with soft
+func (p *Store) Restore(table interface{}, id string) error {
+	s, err := model(table, true)
+	if err != nil {
+		return fmt.Errorf("Restore: %w", err)
+	}
+
+	if !s.soft {
+		return fmt.Errorf("Restore: %w", ErrInvalidParameter)
+	}
+
+	k := p.key(s.name)
+	k.id = id
+
+	err = p.write(func(txn *badger.Txn) error {
+		i, err := txn.Get([]byte(k.recordK()))
+		if err == badger.ErrKeyNotFound {
+			return ErrNoRecord
+		}
+		if err != nil {
+			return err
+		}
+
+		gone, err := p.deleted(txn, s.name, id)
+		if err != nil {
+			return err
+		}
+		if !gone {
+			return ErrNoRecord
+		}
+
+		err = p.mark(txn, k, i, Restored)
+		if err != nil {
+			return err
+		}
+
+		err = txn.Delete([]byte(k.deletedK()))
+		if err != nil {
+			return err
+		}
+
+		err = p.track(txn, s.name, id, Restored, false)
+		if err != nil {
+			return err
+		}
+
+		return p.log(txn, s.audit, s.name, id, Restored, s.fields, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("Restore: %w", err)
+	}
+
+	return nil
+}
+
+// Grave is a soft deleted record Purge left in place
+// because a restrict reference still points at it
+type Grave struct {
+	Table string
+	ID    string
+}
+
+// Purge erases records of the store schema soft deleted longer than
+// olderThan ago, index entries and reference rules are applied as in Delete
+// Records kept by a restrict reference are skipped and returned
+// Each record is erased in its own transaction unless store is Atomic
+// Returns number of records erased
+func (p *Store) Purge(olderThan time.Duration) (int, []Grave, error) {
+	type buried struct {
+		Grave
+		tombstone
+	}
+
+	var bs []buried
+	kept := []Grave{}
+	cut := time.Now().Add(-olderThan).UnixNano()
+	pfx := []byte(strings.Join([]string{_deletedSchema, p.schema, ""}, ":"))
+
+	err := p.db.View(func(txn *badger.Txn) error {
+		itr := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer itr.Close()
+
+		for itr.Seek(pfx); itr.ValidForPrefix(pfx); itr.Next() {
+			table, id, ok := strings.Cut(string(itr.Item().Key()[len(pfx):]), ":")
+			if !ok {
+				continue
+			}
+
+			var t tombstone
+			err := itr.Item().Value(func(v []byte) error {
+				return gob.NewDecoder(bytes.NewReader(v)).Decode(&t)
+			})
+			if err != nil {
+				return err
+			}
+
+			if t.At <= cut {
+				bs = append(bs, buried{Grave{table, id}, t})
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, kept, fmt.Errorf("Purge: %w", err)
+	}
+
+	erase := func(txn *badger.Txn, b buried) error {
+		_, err := p.erase(txn, b.Table, b.Index, b.Types, b.Audit, b.ID, make(map[string]bool))
+		return err
+	}
+
+	if p.atomic {
+		// a restricted record aborts the batch, which is retried without it
+		for {
+			bad := -1
+			err = p.write(func(txn *badger.Txn) error {
+				for n, b := range bs {
+					err := erase(txn, b)
+					if errors.Is(err, ErrReferenced) {
+						bad = n
+					}
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if bad < 0 {
+				break
+			}
+			kept = append(kept, bs[bad].Grave)
+			bs = append(bs[:bad], bs[bad+1:]...)
+		}
+		if errors.Is(err, badger.ErrTxnTooBig) {
+			err = ErrBatchTooBig
+		}
+		if err != nil {
+			return 0, kept, fmt.Errorf("Purge: %w", err)
+		}
+
+		return len(bs), kept, nil
+	}
+
+	n := 0
+	for _, b := range bs {
+		err = p.write(func(txn *badger.Txn) error {
+			return erase(txn, b)
+		})
+		if errors.Is(err, ErrReferenced) {
+			kept = append(kept, b.Grave)
+			continue
+		}
+		if err != nil {
+			return n, kept, fmt.Errorf("Purge: %w", err)
+		}
+		n++
+	}
+
+	return n, kept, nil
+}
+
+// bury soft deletes a record keeping its keys, s must hold all fields
+// Reference rules are applied when Purge erases it
+// Returns false when it does not exist or is already deleted
+func (p *Store) bury(txn *badger.Txn, s *shape, id string) (bool, error) {
+	k := p.key(s.name)
+	k.id = id
+
+	i, err := txn.Get([]byte(k.recordK()))
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("bury: %w", err)
+	}
+
+	gone, err := p.deleted(txn, s.name, id)
+	if err != nil || gone {
+		return false, err
+	}
+
+	before, err := p.prior(txn, s.audit, s.name, id)
+	if err != nil {
+		return false, fmt.Errorf("bury: %w", err)
+	}
+
+	bts, err := toBytes(tombstone{At: time.Now().UnixNano(), Index: s.indexed(), Types: s.fields, Audit: s.audit})
+	if err != nil {
+		return false, fmt.Errorf("bury: %w", err)
+	}
+
+	err = p.mark(txn, k, i, Deleted)
+	if err != nil {
+		return false, fmt.Errorf("bury: %w", err)
+	}
+
+	err = put(txn, []byte(k.deletedK()), bts, i.ExpiresAt())
+	if err != nil {
+		return false, fmt.Errorf("bury: %w", err)
+	}
+
+	err = p.track(txn, s.name, id, Deleted, false)
+	if err != nil {
+		return false, fmt.Errorf("bury: %w", err)
+	}
+
+	err = p.log(txn, s.audit, s.name, id, Deleted, s.fields, before)
+	if err != nil {
+		return false, fmt.Errorf("bury: %w", err)
+	}
+
+	return true, nil
+}
+
+// deleted reports whether record id is soft deleted
+func (p *Store) deleted(txn *badger.Txn, table, id string) (bool, error) {
+	k := p.key(table)
+	k.id = id
+
+	_, err := txn.Get([]byte(k.deletedK()))
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("deleted: %w", err)
+	}
+
+	return true, nil
+}
+
+// mark bumps the version of record k writing op into its marker
+// so watchers see soft deletes and restores
+func (p *Store) mark(txn *badger.Txn, k *bow, i *badger.Item, op Op) error {
+	n, err := version(i)
+	if err != nil {
+		return fmt.Errorf("mark: %w", err)
+	}
+
+	err = put(txn, []byte(k.recordK()), marker(n+1, op), i.ExpiresAt())
+	if err != nil {
+		return fmt.Errorf("mark: %w", err)
+	}
+
+	return nil
+}
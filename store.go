@@ -1,12 +1,14 @@
 package slap
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"reflect"
-	"strings"
+	"sync"
+	"time"
 
-	"github.com/anhuret/gset"
 	"github.com/dgraph-io/badger/v3"
 	"github.com/rs/xid"
 )
@@ -14,6 +16,7 @@ import (
 // DB ...
 type DB struct {
 	*badger.DB
+	shared sync.Map // txns writing contended keys, see write
 }
 
 func initDB(path string) (*DB, error) {
@@ -23,13 +26,17 @@ func initDB(path string) (*DB, error) {
 	if err != nil {
 		return nil, fmt.Errorf("initDB: %w", err)
 	}
-	return &DB{db}, nil
+	return &DB{DB: db}, nil
 }
 
 // Store ...
 type Store struct {
 	db     *DB
 	schema string
+	atomic bool
+	ttl    time.Duration
+	ctx    context.Context
+	clock  func() time.Time
 }
 
 type null struct{}
@@ -48,12 +55,57 @@ var (
 	ErrNoPrimaryID = errors.New("primary ID field does not exist")
 	// ErrMalformedKey ...
 	ErrMalformedKey = errors.New("malformed key or zero key fields")
+	// ErrNoReference ...
+	ErrNoReference = errors.New("referenced record does not exist")
+	// ErrReferenced ...
+	ErrReferenced = errors.New("record is referenced")
+	// ErrInvalidCursor ...
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrVersionConflict ...
+	ErrVersionConflict = errors.New("record version changed")
+	// ErrBatchTooBig ...
+	ErrBatchTooBig = errors.New("atomic batch too large for one transaction")
 
 	void null
 )
 
 const (
-	_indexSchema string = "system.index"
+	_indexSchema   string = "system.index"
+	_refSchema     string = "system.ref"
+	_textSchema    string = "system.text"
+	_docSchema     string = "system.textdoc"
+	_statSchema    string = "system.textstat"
+	_vectorSchema  string = "system.vector"
+	_vecdocSchema  string = "system.vecdoc"
+	_histSchema    string = "system.history"
+	_auditSchema   string = "system.audit"
+	_auditHead     string = "system.audithead"
+	_deletedSchema string = "system.deleted"
+	_formatSchema  string = "system.format"
+
+	_restrict string = "restrict"
+	_cascade  string = "cascade"
+	_setnull  string = "setnull"
+
+	_fold string = "fold"
+	_geo  string = "geo"
+	_text string = "text"
+	_stem string = "stem"
+
+	_vector string = "vector"
+	_ttl    string = "ttl"
+
+	_version string = "version"
+	_history string = "history"
+	_soft    string = "soft"
+	_audit   string = "audit"
+	_created string = "created"
+	_updated string = "updated"
+
+	_point string = "slap.Point"
+
+	// index format written by this version, see reindex
+	_format uint64 = 1
 )
 
 // Key
@@ -64,7 +116,12 @@ func (p *Store) key(table string) *bow {
 	}
 }
 
-func (p *Store) create(s *shape, v vals) (string, error) {
+// create writes a new record from struct obj calling its create hooks
+// Hooks run on a copy, values are taken after BeforeCreate and ID is
+// set before AfterCreate, obj takes the copy once committed
+func (p *Store) create(s *shape, obj reflect.Value) (string, error) {
+	obj = reflect.Indirect(obj)
+	var c reflect.Value
 
 	k := bow{
 		schema: p.schema,
@@ -72,29 +129,103 @@ func (p *Store) create(s *shape, v vals) (string, error) {
 		id:     xid.New().String(),
 	}
 
-	err := p.db.Update(func(txn *badger.Txn) error {
-		err := txn.Set([]byte(k.recordK()), []byte{0})
+	err := p.write(func(txn *badger.Txn) error {
+		c = reflect.New(obj.Type()).Elem()
+		c.Set(obj)
+
+		if h, ok := hook(c).(BeforeCreate); ok {
+			err := h.BeforeCreate(txn)
+			if err != nil {
+				return fmt.Errorf("update: %w", err)
+			}
+		}
+
+		v, err := s.values(c.Interface())
 		if err != nil {
 			return fmt.Errorf("update: %w", err)
 		}
 
+		now := p.now()
+		for _, f := range []string{s.created, s.updated} {
+			if x, ok := v[f].(time.Time); ok && x.IsZero() {
+				v[f] = now
+			}
+		}
+
+		err = invalid(s.validate(v, true), verdict(c))
+		if err != nil {
+			return fmt.Errorf("update: %w", err)
+		}
+
+		err = p.link(txn, s, v)
+		if err != nil {
+			return fmt.Errorf("update: %w", err)
+		}
+
+		exp, _ := p.expiry(s, v)
+
+		err = put(txn, []byte(k.recordK()), marker(1, Created), exp)
+		if err != nil {
+			return fmt.Errorf("update: %w", err)
+		}
+
+		idx := s.indexed()
 		for f := range s.fields {
 			_, k.index = s.index[f]
 			k.field = f
 
+			if reflect.ValueOf(v[f]).IsZero() {
+				continue
+			}
+
 			bts, err := toBytes(v[f])
 			if err != nil {
 				return fmt.Errorf("update: %w", err)
 			}
 
 			if k.index {
-				err = txn.Set([]byte(k.indexK(bts)), []byte{0})
+				key, err := toIndex(v[f], idx[f])
+				if err != nil {
+					return fmt.Errorf("update: %w", err)
+				}
+
+				err = put(txn, []byte(k.indexK(key)), []byte{0}, exp)
 				if err != nil {
 					return fmt.Errorf("update: %w", err)
 				}
 			}
 
-			err = txn.Set([]byte(k.fieldK()), bts)
+			err = put(txn, []byte(k.fieldK()), bts, exp)
+			if err != nil {
+				return fmt.Errorf("update: %w", err)
+			}
+		}
+
+		err = p.index(txn, s, k.id, v, exp)
+		if err != nil {
+			return fmt.Errorf("update: %w", err)
+		}
+
+		err = p.embed(txn, s, k.id, v, exp)
+		if err != nil {
+			return fmt.Errorf("update: %w", err)
+		}
+
+		if s.history {
+			err = p.track(txn, s.name, k.id, Created, true)
+			if err != nil {
+				return fmt.Errorf("update: %w", err)
+			}
+		}
+
+		err = p.log(txn, s.audit, s.name, k.id, Created, s.fields, nil)
+		if err != nil {
+			return fmt.Errorf("update: %w", err)
+		}
+
+		c.FieldByName("ID").Set(reflect.ValueOf(k.id))
+		if h, ok := hook(c).(AfterCreate); ok {
+			err = h.AfterCreate(txn)
 			if err != nil {
 				return fmt.Errorf("update: %w", err)
 			}
@@ -106,59 +237,403 @@ func (p *Store) create(s *shape, v vals) (string, error) {
 		return "", fmt.Errorf("create: %w", err)
 	}
 
+	if obj.CanSet() {
+		obj.Set(c)
+	}
+
 	return k.id, nil
 }
 
-// read ...
-func (p *Store) read(s *shape, id string) (interface{}, error) {
-	obj := reflect.New(s.cast).Elem()
-
-	k := bow{
-		schema: p.schema,
-		table:  s.cast.Name(),
-		id:     id,
+// update writes given values into an existing record
+// Created field is kept, updated field is set to now
+// Zero values remove the field, they are never stored or indexed
+// Written keys keep the record expiry unless a new one is given,
+// which is then applied to every key of the record
+func (p *Store) update(txn *badger.Txn, s *shape, v vals, id string) error {
+	k := p.key(s.name)
+	k.id = id
+
+	i, err := txn.Get([]byte(k.recordK()))
+	if err == badger.ErrKeyNotFound {
+		return fmt.Errorf("update: %w", ErrNoRecord)
+	}
+	if err != nil {
+		return fmt.Errorf("update: %w", err)
 	}
 
-	err := p.db.View(func(txn *badger.Txn) error {
-		_, err := txn.Get([]byte(k.recordK()))
-		if err == badger.ErrKeyNotFound {
-			return fmt.Errorf("View: %w", ErrNoRecord)
-		}
+	if s.soft {
+		gone, err := p.deleted(txn, s.name, id)
 		if err != nil {
-			return fmt.Errorf("View: %w", err)
+			return fmt.Errorf("update: %w", err)
 		}
+		if gone {
+			return fmt.Errorf("update: %w", ErrNoRecord)
+		}
+	}
 
-		obj.FieldByName("ID").Set(reflect.ValueOf(id))
+	delete(s.fields, s.created)
+	if s.updated != "" {
+		s.fields[s.updated] = "time.Time"
+		v[s.updated] = p.now()
+	}
 
-		for f, t := range s.fields {
-			k.field = f
+	err = invalid(s.validate(v, false), nil)
+	if err != nil {
+		return fmt.Errorf("update: %w", err)
+	}
+
+	exp, renew := p.expiry(s, v)
+	if !renew {
+		exp = i.ExpiresAt()
+	}
+
+	before, err := p.prior(txn, s.audit, s.name, id)
+	if err != nil {
+		return fmt.Errorf("update: %w", err)
+	}
 
+	n, err := version(i)
+	if err != nil {
+		return fmt.Errorf("update: %w", err)
+	}
+
+	err = put(txn, []byte(k.recordK()), marker(n+1, Updated), exp)
+	if err != nil {
+		return fmt.Errorf("update: %w", err)
+	}
+
+	err = p.link(txn, s, v)
+	if err != nil {
+		return fmt.Errorf("update: %w", err)
+	}
+
+	idx := s.indexed()
+	for f := range s.fields {
+		_, k.index = s.index[f]
+		k.field = f
+		zero := reflect.ValueOf(v[f]).IsZero()
+
+		bts, err := toBytes(v[f])
+		if err != nil {
+			return fmt.Errorf("update: %w", err)
+		}
+
+		if k.index {
 			i, err := txn.Get([]byte(k.fieldK()))
-			if err == badger.ErrKeyNotFound {
-				continue
+			if err != nil && err != badger.ErrKeyNotFound {
+				return fmt.Errorf("update: %w", err)
+			}
+
+			if err == nil {
+				err = i.Value(func(v []byte) error {
+					key, err := indexKey(v, idx[f])
+					if err != nil {
+						return err
+					}
+					return txn.Delete([]byte(k.indexK(key)))
+				})
+				if err != nil {
+					return fmt.Errorf("update: %w", err)
+				}
 			}
+
+		}
+
+		if zero {
+			err = txn.Delete([]byte(k.fieldK()))
 			if err != nil {
-				return fmt.Errorf("View: %w", err)
+				return fmt.Errorf("update: %w", err)
 			}
+			continue
+		}
 
-			fld := obj.FieldByName(f)
+		if k.index {
+			key, err := toIndex(v[f], idx[f])
+			if err != nil {
+				return fmt.Errorf("update: %w", err)
+			}
 
-			err = i.Value(func(v []byte) error {
-				x, err := fromBytes(v, t)
-				if err != nil {
-					return fmt.Errorf("Value: %w", err)
-				}
+			err = put(txn, []byte(k.indexK(key)), []byte{0}, exp)
+			if err != nil {
+				return fmt.Errorf("update: %w", err)
+			}
+		}
+
+		err = put(txn, []byte(k.fieldK()), bts, exp)
+		if err != nil {
+			return fmt.Errorf("update: %w", err)
+		}
+	}
 
-				fld.Set(reflect.ValueOf(x))
+	err = p.index(txn, s, id, v, exp)
+	if err != nil {
+		return fmt.Errorf("update: %w", err)
+	}
 
-				return nil
-			})
+	err = p.embed(txn, s, id, v, exp)
+	if err != nil {
+		return fmt.Errorf("update: %w", err)
+	}
+
+	if renew {
+		full, err := model(reflect.New(s.cast).Elem().Interface(), true)
+		if err != nil {
+			return fmt.Errorf("update: %w", err)
+		}
+
+		err = p.retime(txn, s.name, full.indexed(), id, exp)
+		if err != nil {
+			return fmt.Errorf("update: %w", err)
+		}
+	}
+
+	err = p.track(txn, s.name, id, Updated, s.history)
+	if err != nil {
+		return fmt.Errorf("update: %w", err)
+	}
+
+	err = p.log(txn, s.audit, s.name, id, Updated, s.fields, before)
+	if err != nil {
+		return fmt.Errorf("update: %w", err)
+	}
+
+	err = p.revalidate(txn, s, id)
+	if err != nil {
+		return fmt.Errorf("update: %w", err)
+	}
+
+	return nil
+}
+
+// delete removes record fields, index entries and marker
+// References to the record are resolved by their rules first
+// Returns false if record does not exist
+// Calls BeforeDelete, soft delete tables only mark the record deleted
+// Seen is passed on to erase
+func (p *Store) delete(txn *badger.Txn, s *shape, id string, seen map[string]bool) (bool, error) {
+	if _, ok := reflect.New(s.cast).Interface().(BeforeDelete); ok {
+		obj, err := p.get(txn, s, id)
+		if errors.Is(err, ErrNoRecord) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("delete: %w", err)
+		}
+
+		err = hook(obj).(BeforeDelete).BeforeDelete(txn)
+		if err != nil {
+			return false, fmt.Errorf("delete: %w", err)
+		}
+	}
+
+	if s.soft {
+		ok, err := p.bury(txn, s, id)
+		if err != nil {
+			return false, fmt.Errorf("delete: %w", err)
+		}
+
+		return ok, nil
+	}
+
+	ok, err := p.erase(txn, s.name, s.indexed(), s.fields, s.audit, id, seen)
+	if err != nil {
+		return false, fmt.Errorf("delete: %w", err)
+	}
+
+	return ok, nil
+}
+
+// erase removes a record knowing only its table and field types
+// Index holds index codecs, types field types for the audit log,
+// audit whether the table is audited
+// Seen maps record keys erased to true, guarding cascades against
+// cycles, and records deleted later in the same batch to false
+func (p *Store) erase(txn *badger.Txn, table string, index, types map[string]string, audit bool, id string, seen map[string]bool) (bool, error) {
+	k := p.key(table)
+	k.id = id
+
+	if seen[k.recordK()] {
+		return true, nil
+	}
+	seen[k.recordK()] = true
+
+	_, err := txn.Get([]byte(k.recordK()))
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("erase: %w", err)
+	}
+
+	err = p.unlink(txn, table, id, seen)
+	if err != nil {
+		return false, fmt.Errorf("erase: %w", err)
+	}
+
+	before, err := p.prior(txn, audit, table, id)
+	if err != nil {
+		return false, fmt.Errorf("erase: %w", err)
+	}
+
+	err = p.untext(txn, table, id)
+	if err != nil {
+		return false, fmt.Errorf("erase: %w", err)
+	}
+
+	keys, err := p.keys(txn, table, index, id)
+	if err != nil {
+		return false, fmt.Errorf("erase: %w", err)
+	}
+
+	for _, key := range keys {
+		err = txn.Delete(key)
+		if err != nil {
+			return false, fmt.Errorf("erase: %w", err)
+		}
+	}
+
+	err = p.track(txn, table, id, Deleted, false)
+	if err != nil {
+		return false, fmt.Errorf("erase: %w", err)
+	}
+
+	err = p.log(txn, audit, table, id, Deleted, types, before)
+	if err != nil {
+		return false, fmt.Errorf("erase: %w", err)
+	}
+
+	return true, nil
+}
+
+// keys lists every key of a record, marker last
+// Covers fields, index entries, text postings and vector buckets
+func (p *Store) keys(txn *badger.Txn, table string, index map[string]string, id string) ([][]byte, error) {
+	k := p.key(table)
+	k.id = id
+
+	var keys [][]byte
+	itr := txn.NewIterator(badger.DefaultIteratorOptions)
+	pfx := []byte(k.recordK() + ":")
+
+	for itr.Seek(pfx); itr.ValidForPrefix(pfx); itr.Next() {
+		i := itr.Item()
+		keys = append(keys, i.KeyCopy(nil))
+
+		k.field = string(i.Key()[len(pfx):])
+		t, ok := index[k.field]
+		if !ok {
+			continue
+		}
+
+		err := i.Value(func(v []byte) error {
+			key, err := indexKey(v, t)
 			if err != nil {
-				return fmt.Errorf("View: %w", err)
+				return err
 			}
+			keys = append(keys, []byte(k.indexK(key)))
+			return nil
+		})
+		if err != nil {
+			itr.Close()
+			return nil, fmt.Errorf("keys: %w", err)
 		}
+	}
+	itr.Close()
 
-		return nil
+	ts, err := p.texts(txn, table, id)
+	if err != nil {
+		return nil, fmt.Errorf("keys: %w", err)
+	}
+
+	vs, err := p.vectors(txn, table, id)
+	if err != nil {
+		return nil, fmt.Errorf("keys: %w", err)
+	}
+
+	keys = append(append(keys, ts...), vs...)
+
+	gone, err := p.deleted(txn, table, id)
+	if err != nil {
+		return nil, fmt.Errorf("keys: %w", err)
+	}
+	if gone {
+		keys = append(keys, []byte(k.deletedK()))
+	}
+
+	return append(keys, []byte(k.recordK())), nil
+}
+
+// retime sets expiry of every key of a record
+func (p *Store) retime(txn *badger.Txn, table string, index map[string]string, id string, exp uint64) error {
+	keys, err := p.keys(txn, table, index, id)
+	if err != nil {
+		return fmt.Errorf("retime: %w", err)
+	}
+
+	for _, key := range keys {
+		i, err := txn.Get(key)
+		if err != nil {
+			return fmt.Errorf("retime: %w", err)
+		}
+
+		val, err := i.ValueCopy(nil)
+		if err != nil {
+			return fmt.Errorf("retime: %w", err)
+		}
+
+		err = put(txn, key, val, exp)
+		if err != nil {
+			return fmt.Errorf("retime: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// expiry resolves record expiry from its ttl field or the store TTL
+// Returns false when neither sets one
+func (p *Store) expiry(s *shape, v vals) (uint64, bool) {
+	switch x := v[s.ttl].(type) {
+	case time.Duration:
+		if x > 0 {
+			return uint64(time.Now().Add(x).Unix()), true
+		}
+	case time.Time:
+		if !x.IsZero() {
+			return uint64(x.Unix()), true
+		}
+	}
+
+	if p.ttl > 0 {
+		return uint64(time.Now().Add(p.ttl).Unix()), true
+	}
+
+	return 0, false
+}
+
+// now reads the store clock
+func (p *Store) now() time.Time {
+	if p.clock != nil {
+		return p.clock()
+	}
+	return time.Now()
+}
+
+// put writes a key expiring at exp unix time, zero never expires
+func put(txn *badger.Txn, key, val []byte, exp uint64) error {
+	e := badger.NewEntry(key, val)
+	e.ExpiresAt = exp
+	return txn.SetEntry(e)
+}
+
+// read ...
+func (p *Store) read(s *shape, id string) (interface{}, error) {
+	var obj reflect.Value
+
+	err := p.db.View(func(txn *badger.Txn) error {
+		var err error
+		obj, err = p.get(txn, s, id)
+		return err
 	})
 	if err != nil {
 		return nil, fmt.Errorf("read: %w", err)
@@ -167,68 +642,195 @@ func (p *Store) read(s *shape, id string) (interface{}, error) {
 	return obj.Interface(), nil
 }
 
-func (p *Store) where(x interface{}) ([]string, error) {
-	s, err := model(x, false)
+// get decodes record fields within a transaction, then calls AfterRead
+// Returns settable struct value
+func (p *Store) get(txn *badger.Txn, s *shape, id string) (reflect.Value, error) {
+	obj, err := p.load(txn, s, id)
 	if err != nil {
-		return nil, fmt.Errorf("where: %w", err)
+		return obj, fmt.Errorf("get: %w", err)
 	}
 
-	v, err := s.values(x)
-	if err != nil {
-		return nil, fmt.Errorf("where: %w", err)
+	if h, ok := hook(obj).(AfterRead); ok {
+		err = h.AfterRead(txn)
+		if err != nil {
+			return obj, fmt.Errorf("get: %w", err)
+		}
 	}
 
+	return obj, nil
+}
+
+// load decodes record fields within a transaction
+func (p *Store) load(txn *badger.Txn, s *shape, id string) (reflect.Value, error) {
+	obj := reflect.New(s.cast).Elem()
+
 	k := bow{
 		schema: p.schema,
 		table:  s.cast.Name(),
+		id:     id,
 	}
 
-	var acc []*gset.Set
+	i, err := txn.Get([]byte(k.recordK()))
+	if err == badger.ErrKeyNotFound {
+		return obj, fmt.Errorf("load: %w", ErrNoRecord)
+	}
+	if err != nil {
+		return obj, fmt.Errorf("load: %w", err)
+	}
 
-	for f := range s.fields {
+	if s.soft {
+		gone, err := p.deleted(txn, s.name, id)
+		if err != nil {
+			return obj, fmt.Errorf("load: %w", err)
+		}
+		if gone {
+			return obj, fmt.Errorf("load: %w", ErrNoRecord)
+		}
+	}
+
+	obj.FieldByName("ID").Set(reflect.ValueOf(id))
+
+	if s.version != "" {
+		n, err := version(i)
+		if err != nil {
+			return obj, fmt.Errorf("load: %w", err)
+		}
+		obj.FieldByName(s.version).SetUint(n)
+	}
+
+	for f, t := range s.fields {
 		k.field = f
 
-		bts, err := toBytes(v[f])
+		i, err := txn.Get([]byte(k.fieldK()))
+		if err == badger.ErrKeyNotFound {
+			continue
+		}
 		if err != nil {
-			return nil, fmt.Errorf("where: %w", err)
+			return obj, fmt.Errorf("load: %w", err)
 		}
 
-		res := p.db.scan(k.stubK(bts))
-		set := gset.New()
-		for _, k := range res {
-			i := strings.Split(k, ":")
-			set.Add(i[len(i)-1])
+		fld := obj.FieldByName(f)
+
+		err = i.Value(func(v []byte) error {
+			x, err := fromBytes(v, t)
+			if err != nil {
+				return fmt.Errorf("Value: %w", err)
+			}
+
+			fld.Set(reflect.ValueOf(x))
+
+			return nil
+		})
+		if err != nil {
+			return obj, fmt.Errorf("load: %w", err)
 		}
+	}
 
-		acc = append(acc, set)
+	return obj, nil
+}
+
+func (p *Store) where(x interface{}) ([]string, error) {
+	ids := []string{}
+
+	s, err := model(x, true)
+	if err != nil {
+		return nil, fmt.Errorf("where: %w", err)
+	}
+
+	err = p.reindex(s)
+	if err != nil {
+		return nil, fmt.Errorf("where: %w", err)
 	}
 
-	switch len(acc) {
-	case 1:
-		return acc[0].ToSlice(), nil
-	case 0:
-		return []string{}, nil
-	default:
-		return acc[0].Intersect(acc[1:]...).ToSlice(), nil
+	err = p.db.View(func(txn *badger.Txn) error {
+		w, err := p.Query(x).walk(txn, s, nil, x, nil)
+		if err != nil {
+			return err
+		}
+		defer w.close()
+
+		for {
+			id, ok, err := w.next()
+			if err != nil || !ok {
+				return err
+			}
+			ids = append(ids, id)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("where: %w", err)
 	}
+
+	return ids, nil
 }
 
-func (db *DB) scan(stub string) []string {
+// prefixed lists keys with given prefix without fetching values
+func prefixed(txn *badger.Txn, pfx []byte) []string {
 	var acc []string
 
-	db.View(func(txn *badger.Txn) error {
-		ops := badger.DefaultIteratorOptions
-		ops.PrefetchValues = false
-		itr := txn.NewIterator(ops)
-		defer itr.Close()
-		pfx := []byte(stub)
+	ops := badger.DefaultIteratorOptions
+	ops.PrefetchValues = false
+	itr := txn.NewIterator(ops)
+	defer itr.Close()
 
-		for itr.Seek(pfx); itr.ValidForPrefix(pfx); itr.Next() {
-			acc = append(acc, string(itr.Item().Key()))
-		}
+	for itr.Seek(pfx); itr.ValidForPrefix(pfx); itr.Next() {
+		acc = append(acc, string(itr.Item().Key()))
+	}
+
+	return acc
+}
+
+// expect fails unless record version equals ver
+func (p *Store) expect(txn *badger.Txn, table, id string, ver uint64) error {
+	k := p.key(table)
+	k.id = id
+
+	i, err := txn.Get([]byte(k.recordK()))
+	if err == badger.ErrKeyNotFound {
+		return fmt.Errorf("expect: %w", ErrNoRecord)
+	}
+	if err != nil {
+		return fmt.Errorf("expect: %w", err)
+	}
+
+	n, err := version(i)
+	if err != nil {
+		return fmt.Errorf("expect: %w", err)
+	}
+	if n != ver {
+		return fmt.Errorf("expect: %w", ErrVersionConflict)
+	}
 
+	return nil
+}
+
+// version reads the counter held by a record marker
+// Markers written before versioning read as zero
+func version(i *badger.Item) (uint64, error) {
+	var n uint64
+	err := i.Value(func(v []byte) error {
+		x, w := binary.Uvarint(v)
+		if w <= 0 {
+			return ErrMalformedKey
+		}
+		n = x
 		return nil
 	})
+	if err != nil {
+		return 0, fmt.Errorf("version: %w", err)
+	}
 
-	return acc
+	return n, nil
+}
+
+// stamp encodes version n
+func stamp(n uint64) []byte {
+	bts := make([]byte, binary.MaxVarintLen64)
+	return bts[:binary.PutUvarint(bts, n)]
+}
+
+// marker encodes a record marker holding version n and the op writing it
+// Watch reads the op, version readers stop after n
+func marker(n uint64, o Op) []byte {
+	return append(stamp(n), byte(o))
 }
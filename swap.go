@@ -0,0 +1,157 @@
+package slap
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// retries of a write aborted by a transaction conflict
+const _retries int = 64
+
+// Increment adds delta to a numeric field of record with given ID
+// Delta is converted to the field type, integer fields only take
+// integer deltas, retried on conflicts
+// Runs BeforeUpdate and validation as Update does
+// Returns the new value
+func (p *Store) Increment(table interface{}, id, field string, delta interface{}) (interface{}, error) {
+	s, err := p.single(table, field)
+	if err != nil {
+		return nil, fmt.Errorf("Increment: %w", err)
+	}
+
+	if !numeric(s.fields[field]) {
+		return nil, fmt.Errorf("Increment: %w", ErrInvalidParameter)
+	}
+
+	d := reflect.ValueOf(delta)
+	if !d.IsValid() || !numeric(d.Type().String()) {
+		return nil, fmt.Errorf("Increment: %w", ErrTypeConversion)
+	}
+	if d.Kind() == reflect.Float64 && s.fields[field] != "float64" {
+		return nil, fmt.Errorf("Increment: %w", ErrTypeConversion)
+	}
+
+	var x interface{}
+	err = p.retry(func(txn *badger.Txn) error {
+		cur, err := p.value(txn, s, id, field)
+		if err != nil {
+			return err
+		}
+
+		x = add(cur, d)
+		return p.set(txn, s, id, field, x)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Increment: %w", err)
+	}
+
+	return x, nil
+}
+
+// CompareAndSwap sets field of record with given ID to new if it holds old
+// Values must be of the field type, retried on conflicts
+// Runs BeforeUpdate and validation as Update does
+// Reports whether the swap happened
+func (p *Store) CompareAndSwap(table interface{}, id, field string, old, new interface{}) (bool, error) {
+	s, err := p.single(table, field)
+	if err != nil {
+		return false, fmt.Errorf("CompareAndSwap: %w", err)
+	}
+
+	t := s.fields[field]
+	for _, x := range []interface{}{old, new} {
+		if x == nil || reflect.TypeOf(x).String() != t {
+			return false, fmt.Errorf("CompareAndSwap: %w", ErrTypeConversion)
+		}
+	}
+
+	var ok bool
+	err = p.retry(func(txn *badger.Txn) error {
+		cur, err := p.value(txn, s, id, field)
+		if err != nil {
+			return err
+		}
+
+		ok = reflect.DeepEqual(cur, old)
+		if !ok {
+			k := p.key(s.name)
+			k.id = id
+			_, err = txn.Get([]byte(k.recordK()))
+			if err == badger.ErrKeyNotFound {
+				return ErrNoRecord
+			}
+			return err
+		}
+
+		return p.set(txn, s, id, field, new)
+	})
+	if err != nil {
+		return false, fmt.Errorf("CompareAndSwap: %w", err)
+	}
+
+	return ok, nil
+}
+
+// single shapes a table down to one stored field
+func (p *Store) single(table interface{}, field string) (*shape, error) {
+	s, err := model(table, true)
+	if err != nil {
+		return nil, fmt.Errorf("single: %w", err)
+	}
+
+	if _, ok := s.fields[field]; !ok {
+		return nil, fmt.Errorf("single: %s %w", field, ErrInvalidParameter)
+	}
+	s.filter([]string{field})
+
+	return s, nil
+}
+
+// set writes x into field of record id through the Update path
+func (p *Store) set(txn *badger.Txn, s *shape, id, field string, x interface{}) error {
+	data := reflect.New(s.cast)
+	data.Elem().FieldByName(field).Set(reflect.ValueOf(x))
+
+	return p.revise(txn, data.Interface(), s, vals{field: x}, id)
+}
+
+// retry runs fn in a read write transaction until it commits
+// Gives up with the conflict after _retries attempts
+func (p *Store) retry(fn func(*badger.Txn) error) error {
+	for n := 0; ; n++ {
+		err := p.write(fn)
+		if errors.Is(err, badger.ErrConflict) && n < _retries {
+			backoff(n)
+			continue
+		}
+		return err
+	}
+}
+
+// backoff sleeps a random time doubling with attempt n up to 16ms
+// so conflicting writers spread out
+func backoff(n int) {
+	if n > 14 {
+		n = 14
+	}
+	time.Sleep(time.Duration(rand.Int63n(int64(time.Microsecond << n))))
+}
+
+// add sums numeric x and delta d in the type of x
+func add(x interface{}, d reflect.Value) interface{} {
+	switch v := x.(type) {
+	case int:
+		return v + int(d.Convert(reflect.TypeOf(v)).Int())
+	case int64:
+		return v + d.Convert(reflect.TypeOf(v)).Int()
+	case float64:
+		return v + d.Convert(reflect.TypeOf(v)).Float()
+	default:
+		return x
+	}
+}
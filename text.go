@@ -0,0 +1,581 @@
+package slap
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Hit is a search result with its relevance score
+type Hit struct {
+	Record interface{}
+	Score  float64
+}
+
+// textdoc lists distinct terms and token count of a text field
+type textdoc struct {
+	Terms []string
+	Len   int
+}
+
+// textstat holds corpus statistics of a text field
+// Kept as a counter by index and drop, records expiring by TTL
+// are not subtracted
+type textstat struct {
+	N     int
+	Total int
+}
+
+// BM25 parameters
+const (
+	_k1 float64 = 1.2
+	_b  float64 = 0.75
+)
+
+// Search finds records whose text tagged fields match query
+// Words must all match, OR between words or phrases matches either
+// Quoted words match as a phrase
+// Hits are ranked by BM25 summed over text fields
+func (p *Store) Search(table interface{}, query string) ([]Hit, error) {
+	hits := []Hit{}
+
+	s, err := model(table, true)
+	if err != nil {
+		return hits, fmt.Errorf("Search: %w", err)
+	}
+
+	if len(s.text) == 0 {
+		return hits, fmt.Errorf("Search: %w", ErrInvalidParameter)
+	}
+
+	groups := parse(query)
+	if len(groups) == 0 {
+		return hits, nil
+	}
+
+	err = p.db.View(func(txn *badger.Txn) error {
+		st, err := p.stats(txn, s)
+		if err != nil {
+			return err
+		}
+
+		var acc map[string]float64
+		k := p.key(s.name)
+
+		for _, g := range groups {
+			m := make(map[string]float64)
+
+			for _, c := range g {
+				for f, mode := range s.text {
+					k.field = f
+					sc, err := p.phrase(txn, k, tokens(c, mode), st[f])
+					if err != nil {
+						return err
+					}
+					for id, x := range sc {
+						m[id] += x
+					}
+				}
+			}
+
+			if acc == nil {
+				acc = m
+				continue
+			}
+			for id := range acc {
+				if x, ok := m[id]; ok {
+					acc[id] += x
+				} else {
+					delete(acc, id)
+				}
+			}
+		}
+
+		ids := make([]string, 0, len(acc))
+		for id := range acc {
+			if s.soft {
+				gone, err := p.deleted(txn, s.name, id)
+				if err != nil {
+					return err
+				}
+				if gone {
+					continue
+				}
+			}
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			if acc[ids[i]] != acc[ids[j]] {
+				return acc[ids[i]] > acc[ids[j]]
+			}
+			return ids[i] < ids[j]
+		})
+
+		for _, id := range ids {
+			obj, err := p.get(txn, s, id)
+			if errors.Is(err, ErrNoRecord) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			hits = append(hits, Hit{Record: obj.Interface(), Score: acc[id]})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return []Hit{}, fmt.Errorf("Search: %w", err)
+	}
+
+	return hits, nil
+}
+
+// parse splits a query into AND groups of OR clauses
+// Quoted text is one clause, OR joins neighbouring clauses
+func parse(q string) [][]string {
+	var groups [][]string
+	or := false
+
+	for {
+		q = strings.TrimLeftFunc(q, unicode.IsSpace)
+		if q == "" {
+			return groups
+		}
+
+		var c string
+		if q[0] == '"' {
+			i := strings.IndexByte(q[1:], '"')
+			if i < 0 {
+				c, q = q[1:], ""
+			} else {
+				c, q = q[1:i+1], q[i+2:]
+			}
+		} else {
+			i := strings.IndexFunc(q, unicode.IsSpace)
+			if i < 0 {
+				i = len(q)
+			}
+			c, q = q[:i], q[i:]
+			if c == "OR" {
+				or = len(groups) > 0
+				continue
+			}
+		}
+
+		if len(tokens(c, "")) == 0 {
+			continue
+		}
+
+		if or {
+			groups[len(groups)-1] = append(groups[len(groups)-1], c)
+		} else {
+			groups = append(groups, []string{c})
+		}
+		or = false
+	}
+}
+
+// tokens splits text into lower cased letter and digit runs
+func tokens(x, mode string) []string {
+	ts := strings.FieldsFunc(strings.ToLower(x), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	if mode == _stem {
+		for i, t := range ts {
+			ts[i] = stem(t)
+		}
+	}
+
+	return ts
+}
+
+// stem strips plural and verb suffixes of English words
+// A light stemmer, stems keep at least three letters
+func stem(w string) string {
+	switch {
+	case strings.HasSuffix(w, "sses"):
+		return w[:len(w)-2]
+	case strings.HasSuffix(w, "ies") && len(w) > 5:
+		return w[:len(w)-3] + "y"
+	case strings.HasSuffix(w, "ss"), strings.HasSuffix(w, "us"), strings.HasSuffix(w, "is"):
+		return w
+	}
+
+	for _, sfx := range []string{"ingly", "edly", "ing", "ed", "s"} {
+		if strings.HasSuffix(w, sfx) && len(w)-len(sfx) >= 3 {
+			return w[:len(w)-len(sfx)]
+		}
+	}
+
+	return w
+}
+
+// index replaces postings of text fields present in v
+func (p *Store) index(txn *badger.Txn, s *shape, id string, v vals, exp uint64) error {
+	k := p.key(s.name)
+	k.id = id
+
+	for f, mode := range s.text {
+		x, ok := v[f].(string)
+		if !ok {
+			continue
+		}
+		k.field = f
+
+		err := p.drop(txn, k)
+		if err != nil {
+			return fmt.Errorf("index: %w", err)
+		}
+
+		ts := tokens(x, mode)
+		if len(ts) == 0 {
+			continue
+		}
+
+		err = p.tally(txn, k, 1, len(ts))
+		if err != nil {
+			return fmt.Errorf("index: %w", err)
+		}
+
+		pos := make(map[string][]int)
+		for i, t := range ts {
+			pos[t] = append(pos[t], i)
+		}
+
+		doc := textdoc{Len: len(ts)}
+		for t, ps := range pos {
+			bts, err := toBytes(ps)
+			if err != nil {
+				return fmt.Errorf("index: %w", err)
+			}
+
+			err = put(txn, []byte(k.textK(t)), bts, exp)
+			if err != nil {
+				return fmt.Errorf("index: %w", err)
+			}
+			doc.Terms = append(doc.Terms, t)
+		}
+		sort.Strings(doc.Terms)
+
+		bts, err := toBytes(doc)
+		if err != nil {
+			return fmt.Errorf("index: %w", err)
+		}
+
+		err = put(txn, []byte(k.docK()), bts, exp)
+		if err != nil {
+			return fmt.Errorf("index: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// texts lists postings and text documents of all text fields of a record
+// Fields are found from text documents so no shape is needed
+func (p *Store) texts(txn *badger.Txn, table, id string) ([][]byte, error) {
+	var keys [][]byte
+	k := p.key(table)
+	k.id = id
+	pfx := k.docK()
+
+	for _, key := range prefixed(txn, []byte(pfx)) {
+		k.field = key[len(pfx):]
+
+		ks, err := p.postingKs(txn, k)
+		if err != nil {
+			return nil, fmt.Errorf("texts: %w", err)
+		}
+		keys = append(keys, ks...)
+	}
+
+	return keys, nil
+}
+
+// drop removes postings and text document of one record field
+func (p *Store) drop(txn *badger.Txn, k *bow) error {
+	doc, err := p.textdoc(txn, k)
+	if err != nil {
+		return fmt.Errorf("drop: %w", err)
+	}
+	if doc == nil {
+		return nil
+	}
+
+	err = p.tally(txn, k, -1, -doc.Len)
+	if err != nil {
+		return fmt.Errorf("drop: %w", err)
+	}
+
+	keys, err := p.postingKs(txn, k)
+	if err != nil {
+		return fmt.Errorf("drop: %w", err)
+	}
+
+	for _, key := range keys {
+		err = txn.Delete(key)
+		if err != nil {
+			return fmt.Errorf("drop: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// textdoc reads the text document of one record field, nil if none
+func (p *Store) textdoc(txn *badger.Txn, k *bow) (*textdoc, error) {
+	i, err := txn.Get([]byte(k.docK()))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("textdoc: %w", err)
+	}
+
+	var doc textdoc
+	err = i.Value(func(v []byte) error {
+		return gob.NewDecoder(bytes.NewReader(v)).Decode(&doc)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("textdoc: %w", err)
+	}
+
+	return &doc, nil
+}
+
+// postingKs lists postings and text document of one record field
+func (p *Store) postingKs(txn *badger.Txn, k *bow) ([][]byte, error) {
+	doc, err := p.textdoc(txn, k)
+	if err != nil {
+		return nil, fmt.Errorf("postingKs: %w", err)
+	}
+	if doc == nil {
+		return nil, nil
+	}
+
+	keys := [][]byte{}
+	for _, t := range doc.Terms {
+		keys = append(keys, []byte(k.textK(t)))
+	}
+
+	return append(keys, []byte(k.docK())), nil
+}
+
+// stats reads document counts and lengths of text fields
+func (p *Store) stats(txn *badger.Txn, s *shape) (map[string]*textstat, error) {
+	st := make(map[string]*textstat)
+	k := p.key(s.name)
+
+	for f := range s.text {
+		k.field = f
+		x, err := p.stat(txn, k)
+		if err != nil {
+			return nil, fmt.Errorf("stats: %w", err)
+		}
+		st[f] = x
+	}
+
+	return st, nil
+}
+
+// stat reads the counter of text field k.field
+// Tables indexed before counters were kept are counted from their documents
+func (p *Store) stat(txn *badger.Txn, k *bow) (*textstat, error) {
+	i, err := txn.Get([]byte(k.statK()))
+	if err == badger.ErrKeyNotFound {
+		return p.census(txn, k)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("stat: %w", err)
+	}
+
+	var st textstat
+	err = i.Value(func(v []byte) error {
+		return gob.NewDecoder(bytes.NewReader(v)).Decode(&st)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("stat: %w", err)
+	}
+
+	return &st, nil
+}
+
+// census counts text documents of field k.field
+func (p *Store) census(txn *badger.Txn, k *bow) (*textstat, error) {
+	st := &textstat{}
+	pfx := []byte(strings.Join([]string{_docSchema, k.schema, k.table, ""}, ":"))
+
+	itr := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer itr.Close()
+
+	for itr.Seek(pfx); itr.ValidForPrefix(pfx); itr.Next() {
+		_, f, ok := strings.Cut(string(itr.Item().Key()[len(pfx):]), ":")
+		if !ok || f != k.field {
+			continue
+		}
+
+		var doc textdoc
+		err := itr.Item().Value(func(v []byte) error {
+			return gob.NewDecoder(bytes.NewReader(v)).Decode(&doc)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("census: %w", err)
+		}
+
+		st.N++
+		st.Total += doc.Len
+	}
+
+	return st, nil
+}
+
+// tally adds n documents of total length to the counter of k.field
+// Called before the document is written or removed, writers of the
+// same field conflict on the counter and are retried by write
+func (p *Store) tally(txn *badger.Txn, k *bow, n, total int) error {
+	st, err := p.stat(txn, k)
+	if err != nil {
+		return fmt.Errorf("tally: %w", err)
+	}
+
+	st.N += n
+	st.Total += total
+
+	bts, err := toBytes(*st)
+	if err != nil {
+		return fmt.Errorf("tally: %w", err)
+	}
+
+	err = txn.Set([]byte(k.statK()), bts)
+	if err != nil {
+		return fmt.Errorf("tally: %w", err)
+	}
+	p.db.shared.Store(txn, null{})
+
+	return nil
+}
+
+// untext subtracts text documents of a record from their counters
+func (p *Store) untext(txn *badger.Txn, table, id string) error {
+	k := p.key(table)
+	k.id = id
+	pfx := k.docK()
+
+	for _, key := range prefixed(txn, []byte(pfx)) {
+		k.field = key[len(pfx):]
+
+		doc, err := p.textdoc(txn, k)
+		if err != nil {
+			return fmt.Errorf("untext: %w", err)
+		}
+
+		err = p.tally(txn, k, -1, -doc.Len)
+		if err != nil {
+			return fmt.Errorf("untext: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// phrase scores records of field k.field holding terms in sequence
+// A single term is a phrase of one
+func (p *Store) phrase(txn *badger.Txn, k *bow, ts []string, st *textstat) (map[string]float64, error) {
+	sc := make(map[string]float64)
+	if len(ts) == 0 || st.N <= 0 {
+		return sc, nil
+	}
+
+	post := make(map[string]map[string][]int)
+	for _, t := range ts {
+		if _, ok := post[t]; ok {
+			continue
+		}
+
+		ps, err := p.postings(txn, k, t)
+		if err != nil {
+			return nil, fmt.Errorf("phrase: %w", err)
+		}
+		post[t] = ps
+	}
+
+	avg := float64(st.Total) / float64(st.N)
+	d := *k
+
+	for id, first := range post[ts[0]] {
+		tf := 0
+		for _, at := range first {
+			if sequence(post, ts, id, at) {
+				tf++
+			}
+		}
+		if tf == 0 {
+			continue
+		}
+
+		d.id = id
+		doc, err := p.textdoc(txn, &d)
+		if err != nil {
+			return nil, fmt.Errorf("phrase: %w", err)
+		}
+
+		dl := avg
+		if doc != nil {
+			dl = float64(doc.Len)
+		}
+		for _, t := range ts {
+			sc[id] += bm25(tf, len(post[t]), st.N, dl, avg)
+		}
+	}
+
+	return sc, nil
+}
+
+// postings maps record IDs to positions of a term
+func (p *Store) postings(txn *badger.Txn, k *bow, term string) (map[string][]int, error) {
+	ps := make(map[string][]int)
+	pfx := []byte(strings.Join([]string{_textSchema, k.schema, k.table, k.field, term, ""}, ":"))
+
+	itr := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer itr.Close()
+
+	for itr.Seek(pfx); itr.ValidForPrefix(pfx); itr.Next() {
+		var pos []int
+		err := itr.Item().Value(func(v []byte) error {
+			return gob.NewDecoder(bytes.NewReader(v)).Decode(&pos)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("postings: %w", err)
+		}
+		ps[string(itr.Item().Key()[len(pfx):])] = pos
+	}
+
+	return ps, nil
+}
+
+// sequence reports whether terms follow each other from position at
+func sequence(post map[string]map[string][]int, ts []string, id string, at int) bool {
+	for i, t := range ts[1:] {
+		pos := post[t][id]
+		j := sort.SearchInts(pos, at+i+1)
+		if j == len(pos) || pos[j] != at+i+1 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func bm25(tf, df, n int, dl, avg float64) float64 {
+	idf := math.Log(1 + (float64(n)-float64(df)+0.5)/(float64(df)+0.5))
+	return idf * float64(tf) * (_k1 + 1) / (float64(tf) + _k1*(1-_b+_b*dl/avg))
+}
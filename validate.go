@@ -0,0 +1,265 @@
+package slap
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Validator is implemented by models checking whole records
+// Validate runs after field rules, on the stored record for updates
+type Validator interface {
+	Validate() error
+}
+
+// FieldError is a failed rule of one field
+// Rule is the tag option as written, min=3 for instance
+type FieldError struct {
+	Field string
+	Rule  string
+}
+
+// ValidationError lists every failing field of a record
+// Err is the error returned by the model Validate method
+type ValidationError struct {
+	Fields []FieldError
+	Err    error
+}
+
+// ErrValidation ...
+var ErrValidation = errors.New("validation failed")
+
+func (e *ValidationError) Error() string {
+	var bld strings.Builder
+	bld.WriteString(ErrValidation.Error())
+
+	for i, f := range e.Fields {
+		if i == 0 {
+			bld.WriteString(": ")
+		} else {
+			bld.WriteString(", ")
+		}
+		bld.WriteString(f.Field + " " + f.Rule)
+	}
+
+	if e.Err != nil {
+		bld.WriteString(": " + e.Err.Error())
+	}
+
+	return bld.String()
+}
+
+// Is matches ErrValidation
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// Unwrap returns the error of the model Validate method
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// rule is a parsed validation tag option
+type rule struct {
+	name string
+	arg  string
+	num  float64
+	re   *regexp.Regexp
+	set  map[string]null
+}
+
+const (
+	_required string = "required"
+	_min      string = "min"
+	_max      string = "max"
+	_len      string = "len"
+	_regexp   string = "regexp"
+	_oneof    string = "oneof"
+)
+
+// rules parses validation options of a field of type t
+// Length rules apply to strings and slices, bounds also to numbers
+func rules(opt map[string]string, t string) ([]rule, error) {
+	rs := []rule{}
+	sized := t == "string" || strings.HasPrefix(t, "[]")
+
+	for _, n := range []string{_required, _min, _max, _len, _regexp, _oneof} {
+		arg, ok := opt[n]
+		if !ok {
+			continue
+		}
+		r := rule{name: n, arg: arg}
+
+		switch n {
+		case _min, _max, _len:
+			x, err := strconv.ParseFloat(arg, 64)
+			if err != nil || (!sized && (n == _len || !numeric(t))) {
+				return nil, ErrInvalidParameter
+			}
+			r.num = x
+		case _regexp:
+			re, err := regexp.Compile(arg)
+			if err != nil || t != "string" {
+				return nil, ErrInvalidParameter
+			}
+			r.re = re
+		case _oneof:
+			if t != "string" && !numeric(t) {
+				return nil, ErrInvalidParameter
+			}
+			r.set = make(map[string]null)
+			for _, x := range strings.Fields(arg) {
+				r.set[x] = void
+			}
+		}
+
+		rs = append(rs, r)
+	}
+
+	return rs, nil
+}
+
+// compiled caches parsed rules by struct type and field
+var compiled sync.Map
+
+type slot struct {
+	typ   reflect.Type
+	field string
+}
+
+// cached returns rules of field f of typ, parsing them once
+func cached(typ reflect.Type, f reflect.StructField, t string) ([]rule, error) {
+	k := slot{typ, f.Name}
+	if rs, ok := compiled.Load(k); ok {
+		return rs.([]rule), nil
+	}
+
+	rs, err := rules(tags(f), t)
+	if err != nil {
+		return nil, err
+	}
+	compiled.Store(k, rs)
+
+	return rs, nil
+}
+
+// pass reports whether a set value x meets the rule
+// Required fails on zero values, other rules check them as given
+func (r rule) pass(x interface{}) bool {
+	v := reflect.ValueOf(x)
+	if !v.IsValid() {
+		return false
+	}
+	if r.name == _required {
+		return !v.IsZero()
+	}
+
+	size := 0.0
+	switch v.Kind() {
+	case reflect.String:
+		size = float64(utf8.RuneCountInString(v.String()))
+	case reflect.Slice:
+		size = float64(v.Len())
+	default:
+		size = float(x)
+	}
+
+	switch r.name {
+	case _min:
+		return size >= r.num
+	case _max:
+		return size <= r.num
+	case _len:
+		return size == r.num
+	case _regexp:
+		return r.re.MatchString(v.String())
+	case _oneof:
+		_, ok := r.set[fmt.Sprint(x)]
+		return ok
+	default:
+		return true
+	}
+}
+
+// validate checks rules of fields set in v
+// All tells v holds every field as in create, where zero values are
+// unset, otherwise fields in v are set even when zero
+// Unset fields only fail required, and only when all is given
+func (s *shape) validate(v vals, all bool) []FieldError {
+	fs := []FieldError{}
+
+	for f, rs := range s.rules {
+		x, ok := v[f]
+		set := ok && (!all || !reflect.ValueOf(x).IsZero())
+
+		for _, r := range rs {
+			if !set && (!all || r.name != _required) {
+				continue
+			}
+			if set && r.pass(x) {
+				continue
+			}
+			n := r.name
+			if r.arg != "" {
+				n += "=" + r.arg
+			}
+			fs = append(fs, FieldError{Field: f, Rule: n})
+		}
+	}
+
+	sort.SliceStable(fs, func(i, j int) bool {
+		return fs[i].Field < fs[j].Field
+	})
+
+	return fs
+}
+
+// invalid joins field errors with the error of a Validate method
+// Returns nil when both pass
+func invalid(fs []FieldError, err error) error {
+	if len(fs) == 0 && err == nil {
+		return nil
+	}
+
+	return &ValidationError{Fields: fs, Err: err}
+}
+
+// verdict calls Validate of obj when its model defines it
+func verdict(obj reflect.Value) error {
+	if h, ok := hook(obj).(Validator); ok {
+		return h.Validate()
+	}
+	return nil
+}
+
+// revalidate calls Validate on record id as stored in txn
+func (p *Store) revalidate(txn *badger.Txn, s *shape, id string) error {
+	if _, ok := reflect.New(s.cast).Interface().(Validator); !ok {
+		return nil
+	}
+
+	full, err := model(reflect.New(s.cast).Elem().Interface(), true)
+	if err != nil {
+		return fmt.Errorf("revalidate: %w", err)
+	}
+
+	obj, err := p.load(txn, full, id)
+	if err != nil {
+		return fmt.Errorf("revalidate: %w", err)
+	}
+
+	err = invalid(nil, verdict(obj))
+	if err != nil {
+		return fmt.Errorf("revalidate: %w", err)
+	}
+
+	return nil
+}
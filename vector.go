@@ -0,0 +1,383 @@
+package slap
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Metric selects how vectors are compared
+type Metric int
+
+const (
+	// Cosine ranks by cosine similarity, highest first
+	Cosine Metric = iota
+	// Dot ranks by dot product, highest first
+	// Candidates come from cosine buckets, so ranking is approximate
+	Dot
+	// L2 ranks by euclidean distance, lowest first
+	// Candidates come from cosine buckets, so ranking is approximate
+	L2
+)
+
+// LSH parameters
+// Each table hashes a vector by signs against _bits random hyperplanes
+const (
+	_tables int   = 4
+	_bits   int   = 12
+	_seed   int64 = 0x51a9
+	// filtered sets up to this size are scanned exactly
+	_exact int = 1000
+)
+
+// planes caches hyperplanes by vector dimension
+var planes sync.Map
+
+// Nearest finds k records whose vector field is closest to vec
+// Query conditions filter records before ranking
+// Candidates come from hyperplane buckets and are ranked exactly,
+// too few candidates fall back to scanning every matching record
+// Buckets group vectors by direction, so Dot and L2 rank the records
+// closest by cosine and may miss records a full scan would return
+// Hit score is the metric value
+func (p *Store) Nearest(q *Query, field string, vec []float32, k int, m Metric) ([]Hit, error) {
+	hits := []Hit{}
+	val := reflect.Indirect(reflect.ValueOf(q.model)).Interface()
+
+	s, err := model(val, true)
+	if err != nil {
+		return hits, fmt.Errorf("Nearest: %w", err)
+	}
+
+	err = p.reindex(s)
+	if err != nil {
+		return hits, fmt.Errorf("Nearest: %w", err)
+	}
+
+	if _, ok := s.vector[field]; !ok || len(vec) == 0 || k <= 0 || m < Cosine || m > L2 {
+		return hits, fmt.Errorf("Nearest: %w", ErrInvalidParameter)
+	}
+
+	err = p.db.View(func(txn *badger.Txn) error {
+		var allow map[string]null
+		c := q.cond(p, val)
+
+		if c.filtered() {
+			allow = make(map[string]null)
+			err := p.collect(txn, c, s, val, allow)
+			if err != nil {
+				return err
+			}
+		}
+
+		ids := make(map[string]null)
+		if allow == nil || len(allow) > _exact {
+			kk := p.key(s.name)
+			kk.field = field
+			p.probe(txn, kk, vec, allow, ids)
+		}
+
+		if len(ids) < k {
+			ids = allow
+			if ids == nil {
+				ids = make(map[string]null)
+				err := p.collect(txn, c, s, val, ids)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		sc := make(map[string]float64)
+		for id := range ids {
+			if s.soft && allow == nil {
+				gone, err := p.deleted(txn, s.name, id)
+				if err != nil {
+					return err
+				}
+				if gone {
+					continue
+				}
+			}
+
+			x, err := p.value(txn, s, id, field)
+			if err != nil {
+				return err
+			}
+			v, _ := x.([]float32)
+			if len(v) != len(vec) {
+				continue
+			}
+			sc[id] = measure(m, vec, v)
+		}
+
+		top := make([]string, 0, len(sc))
+		for id := range sc {
+			top = append(top, id)
+		}
+		sort.Slice(top, func(i, j int) bool {
+			a, b := sc[top[i]], sc[top[j]]
+			if a != b {
+				return (m == L2) == (a < b)
+			}
+			return top[i] < top[j]
+		})
+		if len(top) > k {
+			top = top[:k]
+		}
+
+		for _, id := range top {
+			obj, err := p.get(txn, s, id)
+			if err != nil {
+				return err
+			}
+			hits = append(hits, Hit{Record: obj.Interface(), Score: sc[id]})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return []Hit{}, fmt.Errorf("Nearest: %w", err)
+	}
+
+	return hits, nil
+}
+
+// filtered reports whether query has any condition
+func (q *Query) filtered() bool {
+	if len(q.prefix) > 0 || len(q.areas) > 0 {
+		return true
+	}
+	if q.all {
+		return false
+	}
+
+	return !reflect.Indirect(reflect.ValueOf(q.model)).IsZero()
+}
+
+// collect adds IDs of query results into acc
+func (p *Store) collect(txn *badger.Txn, q *Query, s *shape, val interface{}, acc map[string]null) error {
+	w, err := q.walk(txn, s, nil, val, nil)
+	if err != nil {
+		return fmt.Errorf("collect: %w", err)
+	}
+	defer w.close()
+
+	for {
+		id, ok, err := w.next()
+		if err != nil {
+			return fmt.Errorf("collect: %w", err)
+		}
+		if !ok {
+			return nil
+		}
+		acc[id] = void
+	}
+}
+
+// probe adds records sharing a bucket with vec, or one bit off it
+// Allow limits candidates when set
+func (p *Store) probe(txn *badger.Txn, k *bow, vec []float32, allow, acc map[string]null) {
+	for t, h := range hashes(vec) {
+		for i := -1; i < _bits; i++ {
+			b := h
+			if i >= 0 {
+				b ^= 1 << i
+			}
+			pfx := []byte(strings.Join([]string{_vectorSchema, k.schema, k.table, k.field, bucket(t, b), ""}, ":"))
+
+			for _, key := range prefixed(txn, pfx) {
+				id := key[len(pfx):]
+				if allow != nil {
+					if _, ok := allow[id]; !ok {
+						continue
+					}
+				}
+				acc[id] = void
+			}
+		}
+	}
+}
+
+// embed replaces buckets of vector fields present in v
+func (p *Store) embed(txn *badger.Txn, s *shape, id string, v vals, exp uint64) error {
+	k := p.key(s.name)
+	k.id = id
+
+	for f := range s.vector {
+		x, ok := v[f].([]float32)
+		if !ok {
+			continue
+		}
+		k.field = f
+
+		err := p.unbucket(txn, k)
+		if err != nil {
+			return fmt.Errorf("embed: %w", err)
+		}
+
+		if len(x) == 0 {
+			continue
+		}
+
+		bs := []string{}
+		for t, h := range hashes(x) {
+			bs = append(bs, bucket(t, h))
+			err = put(txn, []byte(k.vectorK(bucket(t, h))), []byte{0}, exp)
+			if err != nil {
+				return fmt.Errorf("embed: %w", err)
+			}
+		}
+
+		bts, err := toBytes(bs)
+		if err != nil {
+			return fmt.Errorf("embed: %w", err)
+		}
+
+		err = put(txn, []byte(k.vecdocK()), bts, exp)
+		if err != nil {
+			return fmt.Errorf("embed: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// vectors lists buckets of all vector fields of a record
+func (p *Store) vectors(txn *badger.Txn, table, id string) ([][]byte, error) {
+	var keys [][]byte
+	k := p.key(table)
+	k.id = id
+	pfx := k.vecdocK()
+
+	for _, key := range prefixed(txn, []byte(pfx)) {
+		k.field = key[len(pfx):]
+
+		ks, err := p.bucketKs(txn, k)
+		if err != nil {
+			return nil, fmt.Errorf("vectors: %w", err)
+		}
+		keys = append(keys, ks...)
+	}
+
+	return keys, nil
+}
+
+// unbucket removes buckets of one record field
+func (p *Store) unbucket(txn *badger.Txn, k *bow) error {
+	keys, err := p.bucketKs(txn, k)
+	if err != nil {
+		return fmt.Errorf("unbucket: %w", err)
+	}
+
+	for _, key := range keys {
+		err = txn.Delete(key)
+		if err != nil {
+			return fmt.Errorf("unbucket: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// bucketKs lists buckets and bucket list of one record field
+func (p *Store) bucketKs(txn *badger.Txn, k *bow) ([][]byte, error) {
+	i, err := txn.Get([]byte(k.vecdocK()))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bucketKs: %w", err)
+	}
+
+	var bs []string
+	err = i.Value(func(v []byte) error {
+		return gob.NewDecoder(bytes.NewReader(v)).Decode(&bs)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bucketKs: %w", err)
+	}
+
+	keys := [][]byte{}
+	for _, b := range bs {
+		keys = append(keys, []byte(k.vectorK(b)))
+	}
+
+	return append(keys, []byte(k.vecdocK())), nil
+}
+
+// hashes hashes a vector once per table
+func hashes(vec []float32) []int {
+	hp := hyperplanes(len(vec))
+	hs := make([]int, _tables)
+
+	for t := range hs {
+		for b := 0; b < _bits; b++ {
+			d := 0.0
+			for i, x := range vec {
+				d += hp[t*_bits+b][i] * float64(x)
+			}
+			if d >= 0 {
+				hs[t] |= 1 << b
+			}
+		}
+	}
+
+	return hs
+}
+
+// hyperplanes returns the hyperplanes of dimension n, one per table bit
+// Drawn once from a fixed seed so hashes stay stable
+func hyperplanes(n int) [][]float64 {
+	if hp, ok := planes.Load(n); ok {
+		return hp.([][]float64)
+	}
+
+	rng := rand.New(rand.NewSource(_seed + int64(n)))
+	hp := make([][]float64, _tables*_bits)
+	for i := range hp {
+		hp[i] = make([]float64, n)
+		for j := range hp[i] {
+			hp[i][j] = rng.NormFloat64()
+		}
+	}
+
+	x, _ := planes.LoadOrStore(n, hp)
+	return x.([][]float64)
+}
+
+// bucket names hash h of table t
+func bucket(t, h int) string {
+	return fmt.Sprintf("%d.%04x", t, h)
+}
+
+func measure(m Metric, a, b []float32) float64 {
+	var dot, na, nb, l2 float64
+	for i := range a {
+		x, y := float64(a[i]), float64(b[i])
+		dot += x * y
+		na += x * x
+		nb += y * y
+		l2 += (x - y) * (x - y)
+	}
+
+	switch m {
+	case Dot:
+		return dot
+	case L2:
+		return math.Sqrt(l2)
+	default:
+		if na == 0 || nb == 0 {
+			return 0
+		}
+		return dot / math.Sqrt(na*nb)
+	}
+}
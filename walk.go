@@ -0,0 +1,843 @@
+package slap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// pred is an equality condition on a non zero field
+// Indexed fields are checked by index key, others by stored value
+// Prefix conditions match the start of an index encoding of type typ
+// Area conditions match geo fields inside an area
+type pred struct {
+	field  string
+	index  bool
+	prefix bool
+	typ    string
+	key    []byte
+	val    []byte
+	area   *area
+}
+
+// preds builds conditions from non zero values of x
+// Indexed conditions sort first so one of them can drive a walk
+func preds(x interface{}) ([]pred, error) {
+	s, err := model(x, false)
+	if err != nil {
+		return nil, fmt.Errorf("preds: %w", err)
+	}
+
+	v, err := s.values(x)
+	if err != nil {
+		return nil, fmt.Errorf("preds: %w", err)
+	}
+
+	idx := s.indexed()
+	ps := []pred{}
+	for f := range s.fields {
+		c := pred{field: f}
+		_, c.index = s.index[f]
+		if idx[f] == _geo {
+			c.index = false
+		}
+
+		if c.index {
+			c.key, err = toIndex(v[f], idx[f])
+		} else {
+			c.val, err = toBytes(v[f])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("preds: %w", err)
+		}
+
+		ps = append(ps, c)
+	}
+
+	sort.Slice(ps, func(i, j int) bool {
+		if ps[i].index != ps[j].index {
+			return ps[i].index
+		}
+		return ps[i].field < ps[j].field
+	})
+
+	return ps, nil
+}
+
+// prefixes builds prefix conditions on indexed string fields
+// Encoding is left unterminated so it prefixes longer values
+// Empty prefixes match every record and are dropped
+func prefixes(s *shape, pfx map[string]string) ([]pred, error) {
+	idx := s.indexed()
+	ps := []pred{}
+
+	for f, v := range pfx {
+		t := idx[f]
+		if t != "string" && t != _fold {
+			return nil, fmt.Errorf("prefixes: %s %w", f, ErrInvalidParameter)
+		}
+		if v == "" {
+			continue
+		}
+
+		key, err := toIndex(v, t)
+		if err != nil {
+			return nil, fmt.Errorf("prefixes: %w", err)
+		}
+
+		ps = append(ps, pred{field: f, prefix: true, typ: t, key: key[:len(key)-2]})
+	}
+
+	sort.Slice(ps, func(i, j int) bool {
+		return ps[i].field < ps[j].field
+	})
+
+	return ps, nil
+}
+
+// test checks conditions against record id
+// Marker requires the record marker to exist as well
+func (p *Store) test(txn *badger.Txn, table string, ps []pred, id string, marker bool) (bool, error) {
+	k := p.key(table)
+	k.id = id
+
+	if marker {
+		_, err := txn.Get([]byte(k.recordK()))
+		if err == badger.ErrKeyNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("test: %w", err)
+		}
+	}
+
+	for _, c := range ps {
+		k.field = c.field
+
+		if c.area != nil {
+			ok, err := p.inside(txn, k, c.area)
+			if err != nil {
+				return false, fmt.Errorf("test: %w", err)
+			}
+			if !ok {
+				return false, nil
+			}
+			continue
+		}
+
+		if c.prefix {
+			ok, err := p.starts(txn, k, c)
+			if err != nil {
+				return false, fmt.Errorf("test: %w", err)
+			}
+			if !ok {
+				return false, nil
+			}
+			continue
+		}
+
+		if c.index {
+			_, err := txn.Get([]byte(k.indexK(c.key)))
+			if err == badger.ErrKeyNotFound {
+				return false, nil
+			}
+			if err != nil {
+				return false, fmt.Errorf("test: %w", err)
+			}
+			continue
+		}
+
+		i, err := txn.Get([]byte(k.fieldK()))
+		if err == badger.ErrKeyNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("test: %w", err)
+		}
+
+		eq := false
+		err = i.Value(func(v []byte) error {
+			eq = bytes.Equal(v, c.val)
+			return nil
+		})
+		if err != nil {
+			return false, fmt.Errorf("test: %w", err)
+		}
+		if !eq {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// starts checks a prefix condition against a stored field
+// Missing fields match as zero values
+func (p *Store) starts(txn *badger.Txn, k *bow, c pred) (bool, error) {
+	i, err := txn.Get([]byte(k.fieldK()))
+	if err == badger.ErrKeyNotFound {
+		key, err := toIndex("", c.typ)
+		return bytes.HasPrefix(key, c.key), err
+	}
+	if err != nil {
+		return false, fmt.Errorf("starts: %w", err)
+	}
+
+	ok := false
+	err = i.Value(func(v []byte) error {
+		key, err := indexKey(v, c.typ)
+		ok = bytes.HasPrefix(key, c.key)
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("starts: %w", err)
+	}
+
+	return ok, nil
+}
+
+// inside checks an area condition against a stored point
+// Missing fields hold no point and never match
+func (p *Store) inside(txn *badger.Txn, k *bow, a *area) (bool, error) {
+	i, err := txn.Get([]byte(k.fieldK()))
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("inside: %w", err)
+	}
+
+	ok := false
+	err = i.Value(func(v []byte) error {
+		x, err := fromBytes(v, _point)
+		if err != nil {
+			return err
+		}
+		ok = a.contains(x.(Point))
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("inside: %w", err)
+	}
+
+	return ok, nil
+}
+
+// walk streams record IDs in result order
+// Key walks hold one iterator, sorted walks serve a prepared slice
+// Index walks merge keys of records missing the field from blank,
+// loaded once the iterator reaches zero, the key they would have
+type walk struct {
+	itr   *badger.Iterator
+	pfx   []byte
+	start []byte
+	skip  []byte
+	stop  []byte
+	desc  bool
+	seen  bool
+	adv   bool
+	id    func(key []byte) (string, bool)
+	test  func(id string) (bool, error)
+	gone  func(id string) (bool, error)
+	blank func() ([][]byte, error)
+	zero  []byte
+	fill  [][]byte
+	ids   []string
+	pos   int
+}
+
+func (w *walk) next() (string, bool, error) {
+	for {
+		id, ok, err := w.step()
+		if err != nil || !ok || w.gone == nil {
+			return id, ok, err
+		}
+
+		gone, err := w.gone(id)
+		if err != nil {
+			return "", false, fmt.Errorf("next: %w", err)
+		}
+		if !gone {
+			return id, true, nil
+		}
+	}
+}
+
+// step yields the next ID before soft deleted records are dropped
+func (w *walk) step() (string, bool, error) {
+	if w.itr == nil {
+		if w.pos >= len(w.ids) {
+			return "", false, nil
+		}
+		w.pos++
+		return w.ids[w.pos-1], true, nil
+	}
+
+	for {
+		key, ok, err := w.key()
+		if err != nil {
+			return "", false, fmt.Errorf("step: %w", err)
+		}
+		if !ok {
+			return "", false, nil
+		}
+
+		if w.stop != nil {
+			c := bytes.Compare(key, w.stop)
+			if (!w.desc && c >= 0) || (w.desc && c <= 0) {
+				return "", false, nil
+			}
+		}
+
+		if w.skip != nil && bytes.Equal(key, w.skip) {
+			continue
+		}
+
+		id, ok := w.id(key)
+		if !ok {
+			continue
+		}
+
+		if w.test != nil {
+			ok, err := w.test(id)
+			if err != nil {
+				return "", false, fmt.Errorf("step: %w", err)
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		return id, true, nil
+	}
+}
+
+// key yields the next iterator key merged with blank keys
+// The iterator only moves past keys already yielded
+func (w *walk) key() ([]byte, bool, error) {
+	switch {
+	case !w.seen:
+		w.itr.Seek(w.start)
+		w.seen = true
+		if w.desc && w.itr.Valid() && bytes.Equal(w.itr.Item().Key(), successor(w.pfx)) {
+			w.itr.Next()
+		}
+	case w.adv:
+		w.itr.Next()
+	}
+	w.adv = false
+
+	var ik []byte
+	if w.itr.ValidForPrefix(w.pfx) {
+		ik = w.itr.Item().Key()
+	}
+
+	before := func(a, b []byte) bool {
+		c := bytes.Compare(a, b)
+		return (!w.desc && c < 0) || (w.desc && c > 0)
+	}
+
+	if w.blank != nil {
+		end := w.zero
+		if w.desc {
+			end = successor(w.zero)
+		}
+
+		if ik == nil || !before(ik, end) {
+			keys, err := w.blank()
+			if err != nil {
+				return nil, false, fmt.Errorf("key: %w", err)
+			}
+			w.blank = nil
+
+			for _, k := range keys {
+				if bytes.HasPrefix(k, w.pfx) && !before(k, w.start) {
+					w.fill = append(w.fill, k)
+				}
+			}
+			sort.Slice(w.fill, func(i, j int) bool {
+				return before(w.fill[i], w.fill[j])
+			})
+		}
+	}
+
+	if len(w.fill) > 0 && (ik == nil || before(w.fill[0], ik)) {
+		k := w.fill[0]
+		w.fill = w.fill[1:]
+		return k, true, nil
+	}
+
+	if ik == nil {
+		return nil, false, nil
+	}
+
+	w.adv = true
+	return ik, true, nil
+}
+
+func (w *walk) close() {
+	if w.itr != nil {
+		w.itr.Close()
+	}
+}
+
+func byID(srt []sorter) bool {
+	return len(srt) == 0 || (len(srt) == 1 && srt[0].field == "ID")
+}
+
+// conds lists query conditions, equalities first then prefixes and areas
+func (q *Query) conds(s *shape, val interface{}) ([]pred, error) {
+	ps := []pred{}
+	if !q.all {
+		var err error
+		ps, err = preds(val)
+		if err != nil {
+			return nil, fmt.Errorf("conds: %w", err)
+		}
+	}
+
+	pp, err := prefixes(s, q.prefix)
+	if err != nil {
+		return nil, fmt.Errorf("conds: %w", err)
+	}
+
+	ga, err := areas(s, q.areas)
+	if err != nil {
+		return nil, fmt.Errorf("conds: %w", err)
+	}
+
+	ps = append(ps, pp...)
+	return append(ps, ga...), nil
+}
+
+// walk streams IDs matching query in result order
+// Soft deleted records are dropped unless the query includes them
+func (q *Query) walk(txn *badger.Txn, s *shape, srt []sorter, val interface{}, after *cursor) (*walk, error) {
+	var gone func(id string) (bool, error)
+	if s.soft && !q.deleted {
+		gone = func(id string) (bool, error) {
+			return q.store.deleted(txn, s.name, id)
+		}
+	}
+
+	w, err := q.pick(txn, s, srt, val, after, gone)
+	if err != nil {
+		return nil, fmt.Errorf("walk: %w", err)
+	}
+
+	if w.itr != nil {
+		w.gone = gone
+	}
+
+	return w, nil
+}
+
+// successor is the first key past every key prefixed by pfx
+// Prefixes always hold a separator so one of their bytes is below 0xff
+func successor(pfx []byte) []byte {
+	s := append([]byte{}, pfx...)
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] < 0xff {
+			s[i]++
+			return s[:i+1]
+		}
+	}
+	return s
+}
+
+// keep is the number of IDs a collected walk holds, zero holds all
+// Pages take one more to peek past their limit
+func (q *Query) keep() int {
+	if q.limit <= 0 {
+		return 0
+	}
+	return q.limit + 1
+}
+
+// trim orders ids and drops those past the first n, zero keeps all
+func trim(ids []string, n int, before func(a, b string) bool) []string {
+	sort.Slice(ids, func(i, j int) bool {
+		return before(ids[i], ids[j])
+	})
+
+	if n > 0 && len(ids) > n {
+		return ids[:n]
+	}
+	return ids
+}
+
+// pick plans the cheapest walk for query conditions and order
+// ID order follows record or index keys, a single indexed sort field
+// follows its index, anything else is sorted in memory
+// Prefix and area conditions without an indexed equality collect
+// their index ranges, collected walks drop gone records as they go
+func (q *Query) pick(txn *badger.Txn, s *shape, srt []sorter, val interface{}, after *cursor, gone func(string) (bool, error)) (*walk, error) {
+	ps, err := q.conds(s, val)
+	if err != nil {
+		return nil, fmt.Errorf("pick: %w", err)
+	}
+
+	eq := len(ps) > 0 && ps[0].index
+	rng := false
+	for _, c := range ps {
+		rng = rng || c.prefix || c.area != nil
+	}
+
+	switch {
+	case byID(srt) && rng && !eq:
+		desc := len(srt) == 1 && srt[0].desc
+		w, err := q.store.byRange(txn, s.name, ps, desc, q.span, after, q.keep(), gone)
+		if err != nil {
+			return nil, fmt.Errorf("pick: %w", err)
+		}
+		return w, nil
+	case byID(srt):
+		desc := len(srt) == 1 && srt[0].desc
+		return q.store.byID(txn, s.name, ps, desc, q.span, after), nil
+	case len(srt) == 1 && s.indexed()[srt[0].field] != "":
+		w, err := q.store.byIndex(txn, s.name, srt[0], ps, q.span, after)
+		if err != nil {
+			return nil, fmt.Errorf("pick: %w", err)
+		}
+		return w, nil
+	default:
+		w, err := q.store.bySort(txn, s.name, srt, ps, q.span, after, q.keep(), gone)
+		if err != nil {
+			return nil, fmt.Errorf("pick: %w", err)
+		}
+		return w, nil
+	}
+}
+
+// byID walks record keys, or index keys of the first indexed condition
+// Both are ordered by record ID
+func (p *Store) byID(txn *badger.Txn, table string, ps []pred, desc bool, sp Span, after *cursor) *walk {
+	k := p.key(table)
+	w := &walk{desc: desc}
+
+	if len(ps) > 0 && ps[0].index {
+		k.field = ps[0].field
+		w.pfx = []byte(k.stubK(ps[0].key))
+		rest := ps[1:]
+		w.test = func(id string) (bool, error) {
+			return p.test(txn, table, rest, id, true)
+		}
+	} else {
+		w.pfx = []byte(k.tableK() + ":")
+		if len(ps) > 0 {
+			w.test = func(id string) (bool, error) {
+				return p.test(txn, table, ps, id, false)
+			}
+		}
+	}
+
+	n := len(w.pfx)
+	w.id = func(key []byte) (string, bool) {
+		id := string(key[n:])
+		return id, !strings.Contains(id, ":")
+	}
+
+	w.start = w.pfx
+	if desc {
+		w.start = successor(w.pfx)
+	}
+	if sp.Seek != "" {
+		w.start = []byte(string(w.pfx) + sp.Seek)
+		if sp.Skip {
+			w.skip = w.start
+		}
+	}
+	if after != nil {
+		w.start = []byte(string(w.pfx) + after.ID)
+		w.skip = w.start
+	}
+	if sp.End != "" {
+		w.stop = []byte(string(w.pfx) + sp.End)
+	}
+
+	ops := badger.DefaultIteratorOptions
+	ops.PrefetchValues = false
+	ops.Reverse = desc
+	w.itr = txn.NewIterator(ops)
+
+	return w
+}
+
+// byIndex walks index keys of the sort field in value then ID order
+// A prefix condition on the sort field narrows the walked range
+func (p *Store) byIndex(txn *badger.Txn, table string, o sorter, ps []pred, sp Span, after *cursor) (*walk, error) {
+	w := &walk{desc: o.desc}
+	k := p.key(table)
+	k.field = o.field
+	base := []byte(k.indexF())
+	w.pfx = base
+
+	rest := []pred{}
+	for _, c := range ps {
+		if c.prefix && c.field == o.field && len(w.pfx) == len(base) {
+			w.pfx = append(append([]byte{}, base...), c.key...)
+			continue
+		}
+		rest = append(rest, c)
+	}
+
+	w.id = func(key []byte) (string, bool) {
+		i := bytes.LastIndexByte(key, ':')
+		return string(key[i+1:]), i >= len(base)
+	}
+	w.test = func(id string) (bool, error) {
+		return p.test(txn, table, rest, id, true)
+	}
+
+	if len(w.pfx) == len(base) {
+		zk, err := toKey(zero(o.typ))
+		if err != nil {
+			return nil, fmt.Errorf("byIndex: %w", err)
+		}
+		w.zero = []byte(string(base) + string(zk) + ":")
+		w.blank = func() ([][]byte, error) {
+			return p.blanks(txn, table, o.field, w.zero)
+		}
+	}
+
+	w.start = w.pfx
+	if o.desc {
+		w.start = successor(w.pfx)
+	}
+
+	switch {
+	case after != nil:
+		if len(after.Key) < len(after.ID) {
+			return nil, fmt.Errorf("byIndex: %w", ErrInvalidCursor)
+		}
+		v := after.Key[:len(after.Key)-len(after.ID)]
+		if o.desc {
+			v = invert(v)
+		}
+		w.start = []byte(string(base) + string(v) + ":" + after.ID)
+		w.skip = w.start
+	case sp.Seek != "":
+		v, err := p.sortval(txn, table, o, sp.Seek)
+		if err != nil {
+			return nil, fmt.Errorf("byIndex: %w", err)
+		}
+		w.start = []byte(string(base) + string(v) + ":" + sp.Seek)
+		if sp.Skip {
+			w.skip = w.start
+		}
+	}
+
+	if sp.End != "" {
+		v, err := p.sortval(txn, table, o, sp.End)
+		if err != nil {
+			return nil, fmt.Errorf("byIndex: %w", err)
+		}
+		w.stop = []byte(string(base) + string(v) + ":" + sp.End)
+	}
+
+	ops := badger.DefaultIteratorOptions
+	ops.PrefetchValues = false
+	ops.Reverse = o.desc
+	w.itr = txn.NewIterator(ops)
+
+	return w, nil
+}
+
+// blanks lists IDs of table records missing field under prefix pfx
+func (p *Store) blanks(txn *badger.Txn, table, field string, pfx []byte) ([][]byte, error) {
+	k := p.key(table)
+	k.field = field
+	tk := []byte(k.tableK() + ":")
+
+	ops := badger.DefaultIteratorOptions
+	ops.PrefetchValues = false
+	itr := txn.NewIterator(ops)
+	defer itr.Close()
+
+	keys := [][]byte{}
+	for itr.Seek(tk); itr.ValidForPrefix(tk); itr.Next() {
+		id := string(itr.Item().Key()[len(tk):])
+		if strings.Contains(id, ":") {
+			continue
+		}
+
+		k.id = id
+		_, err := txn.Get([]byte(k.fieldK()))
+		if err == nil {
+			continue
+		}
+		if err != badger.ErrKeyNotFound {
+			return nil, fmt.Errorf("blanks: %w", err)
+		}
+
+		keys = append(keys, []byte(string(pfx)+id))
+	}
+
+	return keys, nil
+}
+
+// byRange collects IDs under index ranges of the first prefix or area
+// condition, areas are still tested as cells only bound them
+// IDs are served in ID order with span and cursor compared as IDs
+// Only the first n IDs past the span start are held, zero holds all
+func (p *Store) byRange(txn *badger.Txn, table string, ps []pred, desc bool, sp Span, after *cursor, n int, gone func(string) (bool, error)) (*walk, error) {
+	var c *pred
+	rest := []pred{}
+	for i, x := range ps {
+		if c == nil && (x.prefix || x.area != nil) {
+			c = &ps[i]
+			if x.prefix {
+				continue
+			}
+		}
+		rest = append(rest, x)
+	}
+
+	// ranges bound value bytes, upper bounds compare on their length
+	var rs [][2][]byte
+	if c.prefix {
+		rs = append(rs, [2][]byte{c.key, c.key})
+	} else {
+		for _, r := range c.area.spans() {
+			lo, hi := make([]byte, 8), make([]byte, 8)
+			binary.BigEndian.PutUint64(lo, r[0])
+			binary.BigEndian.PutUint64(hi, r[1])
+			rs = append(rs, [2][]byte{lo, hi})
+		}
+	}
+
+	before := func(a, b string) bool {
+		if desc {
+			return a > b
+		}
+		return a < b
+	}
+
+	from, incl := sp.Seek, !sp.Skip
+	if after != nil {
+		from, incl = after.ID, false
+	}
+
+	k := p.key(table)
+	k.field = c.field
+	pfx := []byte(k.indexF())
+
+	ops := badger.DefaultIteratorOptions
+	ops.PrefetchValues = false
+	itr := txn.NewIterator(ops)
+	defer itr.Close()
+
+	ids := []string{}
+	for _, r := range rs {
+		for itr.Seek(append(append([]byte{}, pfx...), r[0]...)); itr.ValidForPrefix(pfx); itr.Next() {
+			key := itr.Item().Key()
+			v := key[len(pfx):]
+			if len(v) > len(r[1]) {
+				v = v[:len(r[1])]
+			}
+			if bytes.Compare(v, r[1]) > 0 {
+				break
+			}
+
+			id := string(key[bytes.LastIndexByte(key, ':')+1:])
+			if from != "" && (before(id, from) || (!incl && id == from)) {
+				continue
+			}
+			if sp.End != "" && !before(id, sp.End) {
+				continue
+			}
+
+			ok, err := p.test(txn, table, rest, id, true)
+			if err == nil && ok && gone != nil {
+				ok, err = gone(id)
+				ok = !ok
+			}
+			if err != nil {
+				return nil, fmt.Errorf("byRange: %w", err)
+			}
+			if !ok {
+				continue
+			}
+
+			ids = append(ids, id)
+			if n > 0 && len(ids) >= 2*n {
+				ids = trim(ids, n, before)
+			}
+		}
+	}
+
+	return &walk{ids: trim(ids, n, before)}, nil
+}
+
+// bySort collects matching IDs and sorts them by composite keys
+// Span and cursor positions are compared as composite keys too
+// Only the first n IDs past the span start are held, zero holds all
+func (p *Store) bySort(txn *badger.Txn, table string, srt []sorter, ps []pred, sp Span, after *cursor, n int, gone func(string) (bool, error)) (*walk, error) {
+	var from, end []byte
+	incl := true
+	switch {
+	case after != nil:
+		from, incl = after.Key, false
+	case sp.Seek != "":
+		c, err := p.composite(txn, table, srt, sp.Seek)
+		if err != nil {
+			return nil, fmt.Errorf("bySort: %w", err)
+		}
+		from, incl = c, !sp.Skip
+	}
+
+	if sp.End != "" {
+		c, err := p.composite(txn, table, srt, sp.End)
+		if err != nil {
+			return nil, fmt.Errorf("bySort: %w", err)
+		}
+		end = c
+	}
+
+	src := p.byID(txn, table, ps, false, Span{}, nil)
+	src.gone = gone
+	defer src.close()
+
+	ids := []string{}
+	keys := make(map[string][]byte)
+	before := func(a, b string) bool {
+		return bytes.Compare(keys[a], keys[b]) < 0
+	}
+
+	for {
+		id, ok, err := src.next()
+		if err != nil {
+			return nil, fmt.Errorf("bySort: %w", err)
+		}
+		if !ok {
+			break
+		}
+
+		c, err := p.composite(txn, table, srt, id)
+		if err != nil {
+			return nil, fmt.Errorf("bySort: %w", err)
+		}
+		if end != nil && bytes.Compare(c, end) >= 0 {
+			continue
+		}
+		if x := bytes.Compare(c, from); from != nil && (x < 0 || (!incl && x == 0)) {
+			continue
+		}
+
+		keys[id] = c
+		ids = append(ids, id)
+		if n > 0 && len(ids) >= 2*n {
+			ids = trim(ids, 0, before)
+			for _, id := range ids[n:] {
+				delete(keys, id)
+			}
+			ids = ids[:n]
+		}
+	}
+
+	return &walk{ids: trim(ids, n, before)}, nil
+}
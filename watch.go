@@ -0,0 +1,215 @@
+package slap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/pb"
+)
+
+// Op is the kind of a record change
+type Op int
+
+const (
+	// Created is a new record
+	Created Op = iota + 1
+	// Updated is a change to fields of an existing record
+	Updated
+	// Deleted is a removed record
+	Deleted
+	// Restored is a soft deleted record brought back
+	Restored
+)
+
+func (o Op) String() string {
+	switch o {
+	case Created:
+		return "created"
+	case Updated:
+		return "updated"
+	case Deleted:
+		return "deleted"
+	case Restored:
+		return "restored"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a change of one record within one transaction
+// Record holds the ID and the changed field values, Fields names them
+// Version is the commit timestamp shared by events of a transaction
+type Event struct {
+	Op      Op
+	ID      string
+	Fields  []string
+	Record  interface{}
+	Version uint64
+}
+
+// Watch calls fn with events of each transaction changing query table
+// Blocks until ctx is done, which returns nil, or fn returns an error
+// Creates and updates are checked against query conditions using the
+// stored record at delivery, deletes are always delivered
+// Soft deletes are delivered as deletes, restores as Restored
+func (p *Store) Watch(ctx context.Context, q *Query, fn func([]Event) error) error {
+	val := reflect.Indirect(reflect.ValueOf(q.model)).Interface()
+
+	s, err := model(val, true)
+	if err != nil {
+		return fmt.Errorf("Watch: %w", err)
+	}
+
+	err = p.reindex(s)
+	if err != nil {
+		return fmt.Errorf("Watch: %w", err)
+	}
+
+	c := q.cond(p, val)
+	ps, err := c.conds(s, val)
+	if err != nil {
+		return fmt.Errorf("Watch: %w", err)
+	}
+
+	pfx := p.key(s.name).tableK() + ":"
+
+	err = p.db.Subscribe(ctx, func(kvs *badger.KVList) error {
+		for _, evs := range p.events(s, pfx, kvs.Kv) {
+			var err error
+			if len(ps) > 0 {
+				evs, err = p.match(s, ps, evs)
+				if err != nil {
+					return err
+				}
+			}
+			if len(evs) == 0 {
+				continue
+			}
+
+			err = fn(evs)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}, []pb.Match{{Prefix: []byte(pfx)}})
+	if err != nil && !errors.Is(err, ctx.Err()) {
+		return fmt.Errorf("Watch: %w", err)
+	}
+
+	return nil
+}
+
+// events groups changed keys per transaction then per record
+// Markers carry the op writing them, marker deletes are deletes
+func (p *Store) events(s *shape, pfx string, kvs []*pb.KV) [][]Event {
+	type change struct {
+		ev  Event
+		obj reflect.Value
+	}
+
+	txs := make(map[uint64]map[string]*change)
+
+	for _, kv := range kvs {
+		id, f, field := strings.Cut(string(kv.Key[len(pfx):]), ":")
+		if strings.Contains(f, ":") {
+			continue
+		}
+
+		tx, ok := txs[kv.Version]
+		if !ok {
+			tx = make(map[string]*change)
+			txs[kv.Version] = tx
+		}
+
+		c, ok := tx[id]
+		if !ok {
+			c = &change{ev: Event{Op: Updated, ID: id, Fields: []string{}, Version: kv.Version}}
+			c.obj = reflect.New(s.cast).Elem()
+			c.obj.FieldByName("ID").Set(reflect.ValueOf(id))
+			tx[id] = c
+		}
+
+		if !field {
+			if _, w := binary.Uvarint(kv.Value); len(kv.Value) == 0 {
+				c.ev.Op = Deleted
+			} else if w > 0 && w < len(kv.Value) {
+				c.ev.Op = Op(kv.Value[w])
+			}
+			continue
+		}
+
+		t, known := s.fields[f]
+		if !known || len(kv.Value) == 0 {
+			continue
+		}
+
+		x, err := fromBytes(kv.Value, t)
+		if err != nil {
+			continue
+		}
+		c.obj.FieldByName(f).Set(reflect.ValueOf(x))
+		c.ev.Fields = append(c.ev.Fields, f)
+	}
+
+	vs := make([]uint64, 0, len(txs))
+	for v := range txs {
+		vs = append(vs, v)
+	}
+	sort.Slice(vs, func(i, j int) bool {
+		return vs[i] < vs[j]
+	})
+
+	acc := [][]Event{}
+	for _, v := range vs {
+		evs := []Event{}
+		for _, c := range txs[v] {
+			if c.ev.Op == Deleted {
+				c.ev.Fields = []string{}
+				c.obj = reflect.New(s.cast).Elem()
+				c.obj.FieldByName("ID").Set(reflect.ValueOf(c.ev.ID))
+			}
+			sort.Strings(c.ev.Fields)
+			c.ev.Record = c.obj.Interface()
+			evs = append(evs, c.ev)
+		}
+		sort.Slice(evs, func(i, j int) bool {
+			return evs[i].ID < evs[j].ID
+		})
+		acc = append(acc, evs)
+	}
+
+	return acc
+}
+
+// match keeps deletes and events of records meeting conditions
+func (p *Store) match(s *shape, ps []pred, evs []Event) ([]Event, error) {
+	acc := []Event{}
+
+	err := p.db.View(func(txn *badger.Txn) error {
+		for _, e := range evs {
+			if e.Op != Deleted {
+				ok, err := p.test(txn, s.name, ps, e.ID, true)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					continue
+				}
+			}
+			acc = append(acc, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("match: %w", err)
+	}
+
+	return acc, nil
+}